@@ -0,0 +1,154 @@
+package tidl
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GetPictureURL returns the url of the artist picture at the given size,
+// tidal serves 160, 320, 480 and 750
+func (a Artist) GetPictureURL(size int) string {
+	if a.Picture == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("https://resources.tidal.com/images/%v/%vx%v.jpg", strings.Replace(a.Picture, "-", "/", -1), size, size)
+}
+
+// GetArt fetches the largest artist picture
+func (a Artist) GetArt() ([]byte, error) {
+	u := a.GetPictureURL(750)
+	if u == "" {
+		return nil, errors.New("artist has no picture")
+	}
+
+	return fetch(u)
+}
+
+// GetArtistTopTracks func
+func (t *Tidal) GetArtistTopTracks(artist string, l int) ([]Track, error) {
+	var s struct {
+		Items []Track `json:"items"`
+	}
+
+	var limit string
+	if l > 0 {
+		limit = strconv.Itoa(l)
+	}
+
+	return s.Items, t.get(fmt.Sprintf("artists/%s/toptracks", artist), &url.Values{
+		"limit": {limit},
+	}, &s)
+}
+
+// GetSimilarArtists func
+func (t *Tidal) GetSimilarArtists(artist string, l int) ([]Artist, error) {
+	var s struct {
+		Items []Artist `json:"items"`
+	}
+
+	var limit string
+	if l > 0 {
+		limit = strconv.Itoa(l)
+	}
+
+	return s.Items, t.get(fmt.Sprintf("artists/%s/similar", artist), &url.Values{
+		"limit": {limit},
+	}, &s)
+}
+
+// tidal links other entities inside bios with [wimpLink artistId="1"]..[/wimpLink]
+var wimpLink = regexp.MustCompile(`\[/?wimpLink[^\]]*\]`)
+
+// GetArtistBio returns the artist biography as plain text
+func (t *Tidal) GetArtistBio(artist string) (string, error) {
+	var s struct {
+		Source string `json:"source"`
+		Text   string `json:"text"`
+	}
+
+	err := t.get(fmt.Sprintf("artists/%s/bio", artist), &url.Values{}, &s)
+	if err != nil {
+		return "", err
+	}
+
+	text := wimpLink.ReplaceAllString(s.Text, "")
+	text = strings.Replace(text, "<br/>", "\n", -1)
+
+	if s.Source != "" {
+		text += "\n\nSource: " + s.Source
+	}
+
+	return strings.TrimSpace(text) + "\n", nil
+}
+
+// DownloadArtistTopTracks downloads an artist's top n tracks into a playlist
+// style folder
+func (t *Tidal) DownloadArtistTopTracks(artist Artist, n int) error {
+	tracks, err := t.GetArtistTopTracks(artist.ID.String(), n)
+	if err != nil {
+		return err
+	}
+
+	if len(tracks) == 0 {
+		return errors.New("artist has no top tracks")
+	}
+
+	p := Playlist{
+		ID:             "artist:" + artist.ID.String() + ":top",
+		Title:          artist.Name + " - Top Tracks",
+		NumberOfTracks: len(tracks),
+		Tracks:         tracks,
+	}
+
+	for _, tr := range tracks {
+		d, _ := tr.Duration.Int64()
+		p.Duration += int(d)
+	}
+
+	art, _ := artist.GetArt()
+
+	return t.downloadPlaylist(t.playlistTemplate(), p, art)
+}
+
+// writeArtistInfo writes artist.jpg and bio.txt into dir unless they're
+// already there
+func (t *Tidal) writeArtistInfo(dir, id string) error {
+	picture := dir + "/artist.jpg"
+	bio := dir + "/bio.txt"
+
+	_, errPicture := os.Stat(picture)
+	_, errBio := os.Stat(bio)
+	if errPicture == nil && errBio == nil {
+		return nil
+	}
+
+	artist, err := t.GetArtist(id)
+	if err != nil {
+		return err
+	}
+
+	if os.IsNotExist(errPicture) {
+		if body, err := artist.GetArt(); err == nil {
+			if err := ioutil.WriteFile(picture, body, 0777); err != nil {
+				return err
+			}
+		}
+	}
+
+	if os.IsNotExist(errBio) {
+		if text, err := t.GetArtistBio(id); err == nil && strings.TrimSpace(text) != "" {
+			if err := ioutil.WriteFile(bio, []byte(text), 0777); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package tidl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FeatMode decides where featured artists are credited
+type FeatMode int
+
+const (
+	// FeatNone credits every artist in ARTIST and leaves titles alone
+	FeatNone FeatMode = iota
+	// FeatTitle credits main artists in ARTIST and appends "(feat. X)" to
+	// the title, in tags and file names
+	FeatTitle
+	// FeatArtist credits "Main feat. X" in ARTIST
+	FeatArtist
+)
+
+// ParseFeatMode parses "none", "title" or "artist"
+func ParseFeatMode(s string) (FeatMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return FeatNone, nil
+	case "title":
+		return FeatTitle, nil
+	case "artist":
+		return FeatArtist, nil
+	}
+
+	return FeatNone, fmt.Errorf("unknown feat mode: %q", s)
+}
+
+// ArtistFormat controls how multiple artists are joined into display strings
+type ArtistFormat struct {
+	// Separator goes between artists, ", " when empty
+	Separator string
+	// LastSeparator goes before the last artist, " & " when empty
+	LastSeparator string
+	// Feat picks where featured artists go
+	Feat FeatMode
+	// MultiValue writes one ARTIST tag per artist instead of a joined one
+	MultiValue bool
+}
+
+func (f ArtistFormat) join(names []string) string {
+	sep, last := f.Separator, f.LastSeparator
+	if sep == "" {
+		sep = ", "
+	}
+	if last == "" {
+		last = " & "
+	}
+
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	}
+
+	return strings.Join(names[:len(names)-1], sep) + last + names[len(names)-1]
+}
+
+// apply fills in the display artist and title of tr
+func (f ArtistFormat) apply(tr Track) Track {
+	main, featured := splitArtists(tr.Artist, tr.Artists)
+
+	tr.displayArtist = f.join(append(main, featured...))
+	tr.displayTitle = tr.Title
+
+	if len(featured) == 0 {
+		return tr
+	}
+
+	switch f.Feat {
+	case FeatTitle:
+		tr.displayArtist = f.join(main)
+		if !strings.Contains(strings.ToLower(tr.Title), "feat.") {
+			tr.displayTitle = fmt.Sprintf("%v (feat. %v)", tr.Title, f.join(featured))
+		}
+	case FeatArtist:
+		tr.displayArtist = f.join(main) + " feat. " + f.join(featured)
+	}
+
+	return tr
+}
+
+// albumArtists joins the main artists of the album
+func (f ArtistFormat) albumArtists(al Album) string {
+	main, _ := splitArtists(al.Artist, al.Artists)
+	return f.join(main)
+}
+
+// splitArtists returns the names of the main and featured artists, falling
+// back to the primary artist when tidal didn't send a list
+func splitArtists(primary Artist, artists []Artist) (main, featured []string) {
+	for _, a := range artists {
+		if a.Type == "FEATURED" {
+			featured = append(featured, a.Name)
+		} else {
+			main = append(main, a.Name)
+		}
+	}
+
+	if len(main) == 0 && primary.Name != "" {
+		main = []string{primary.Name}
+	}
+
+	return main, featured
+}
+
+// artistTags returns the ARTIST, ARTISTS and ALBUMARTIST tags of the track
+func (f ArtistFormat) artistTags(tr Track) [][2]string {
+	var tags [][2]string
+
+	main, featured := splitArtists(tr.Artist, tr.Artists)
+	all := append(main, featured...)
+
+	if f.MultiValue {
+		for _, name := range all {
+			tags = append(tags, [2]string{"ARTIST", name})
+		}
+	} else {
+		tags = append(tags, [2]string{"ARTIST", tr.artistName()})
+	}
+
+	for _, name := range all {
+		tags = append(tags, [2]string{"ARTISTS", name})
+	}
+
+	if albumArtist := f.albumArtists(tr.Album); albumArtist != "" {
+		tags = append(tags, [2]string{"ALBUMARTIST", albumArtist})
+	}
+
+	return tags
+}
+
+// artistName is the display artist, the primary artist when it wasn't set
+func (tr Track) artistName() string {
+	if tr.displayArtist != "" {
+		return tr.displayArtist
+	}
+
+	return tr.Artist.Name
+}
+
+// titleName is the display title, the plain title when it wasn't set
+func (tr Track) titleName() string {
+	if tr.displayTitle != "" {
+		return tr.displayTitle
+	}
+
+	return tr.Title
+}
@@ -0,0 +1,101 @@
+package tidl
+
+import (
+	"fmt"
+	"testing"
+)
+
+// featTrack has two main artists and a featured one
+func featTrack(title string) Track {
+	return Track{
+		Title:  title,
+		Artist: Artist{Name: "One"},
+		Artists: []Artist{
+			{Name: "One", Type: "MAIN"},
+			{Name: "Two", Type: "MAIN"},
+			{Name: "Guest", Type: "FEATURED"},
+		},
+		Album: Album{
+			Artist:  Artist{Name: "One"},
+			Artists: []Artist{{Name: "One", Type: "MAIN"}, {Name: "Two", Type: "MAIN"}},
+		},
+	}
+}
+
+func TestArtistFormatApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ArtistFormat
+		track  Track
+		artist string
+		title  string
+	}{
+		{"none", ArtistFormat{}, featTrack("Song"), "One, Two & Guest", "Song"},
+		{"separators", ArtistFormat{Separator: "; ", LastSeparator: "; "}, featTrack("Song"), "One; Two; Guest", "Song"},
+		{"title", ArtistFormat{Feat: FeatTitle}, featTrack("Song"), "One & Two", "Song (feat. Guest)"},
+		{"title already credits", ArtistFormat{Feat: FeatTitle}, featTrack("Song (feat. Guest)"), "One & Two", "Song (feat. Guest)"},
+		{"artist", ArtistFormat{Feat: FeatArtist}, featTrack("Song"), "One & Two feat. Guest", "Song"},
+		{"no list", ArtistFormat{Feat: FeatTitle}, Track{Title: "Song", Artist: Artist{Name: "Solo"}}, "Solo", "Song"},
+	}
+
+	for _, tt := range tests {
+		tr := tt.format.apply(tt.track)
+		if tr.artistName() != tt.artist || tr.titleName() != tt.title {
+			t.Errorf("%v: got %q - %q, want %q - %q", tt.name, tr.artistName(), tr.titleName(), tt.artist, tt.title)
+		}
+	}
+}
+
+func TestArtistTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ArtistFormat
+		want   [][2]string
+	}{
+		{
+			"joined",
+			ArtistFormat{Feat: FeatArtist},
+			[][2]string{
+				{"ARTIST", "One & Two feat. Guest"},
+				{"ARTISTS", "One"},
+				{"ARTISTS", "Two"},
+				{"ARTISTS", "Guest"},
+				{"ALBUMARTIST", "One & Two"},
+			},
+		},
+		{
+			"multi-value",
+			ArtistFormat{MultiValue: true},
+			[][2]string{
+				{"ARTIST", "One"},
+				{"ARTIST", "Two"},
+				{"ARTIST", "Guest"},
+				{"ARTISTS", "One"},
+				{"ARTISTS", "Two"},
+				{"ARTISTS", "Guest"},
+				{"ALBUMARTIST", "One & Two"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tr := tt.format.apply(featTrack("Song"))
+		if got := tt.format.artistTags(tr); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v: got  %v\nwant %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFeatMode(t *testing.T) {
+	tests := map[string]FeatMode{"": FeatNone, "none": FeatNone, "Title": FeatTitle, " artist": FeatArtist}
+
+	for in, want := range tests {
+		if got, err := ParseFeatMode(in); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	if _, err := ParseFeatMode("bogus"); err == nil {
+		t.Error("bogus parsed")
+	}
+}
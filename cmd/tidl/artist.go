@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// artist <id> --top N
+func runArtist(t *tidl.Tidal, args []string) {
+	fs := flag.NewFlagSet("artist", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of top tracks to download")
+
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Println("usage: tidl artist <id> [--top N]")
+		os.Exit(1)
+	}
+
+	for _, id := range args {
+		ref, err := tidl.ParseRef(id)
+		if err != nil || (ref.Type != tidl.RefArtist && ref.Type != tidl.RefUnknown) {
+			fmt.Println("not an artist: " + id)
+			continue
+		}
+
+		artist, err := t.GetArtist(ref.ID)
+		if err != nil || artist.ID.String() == "" {
+			fmt.Println("can't get artist info")
+			os.Exit(5)
+		}
+
+		fmt.Printf("[%v] %v - Top %v\n", artist.ID, artist.Name, *top)
+		if err := t.DownloadArtistTopTracks(artist, *top); err != nil {
+			fmt.Println("can't download top tracks")
+			os.Exit(8)
+		}
+	}
+}
+
+// parseInterspersed lets flags follow positional args, which the flag package
+// doesn't do on its own
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// lyrics <dir>
+func runLyrics(t *tidl.Tidal, args []string) {
+	fs := flag.NewFlagSet("lyrics", flag.ExitOnError)
+
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Println("usage: tidl lyrics <dir>")
+		os.Exit(1)
+	}
+
+	for _, dir := range args {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || !retaggable(path) {
+				return nil
+			}
+
+			changed, err := t.BackfillLyrics(path)
+			switch {
+			case err != nil:
+				fmt.Printf("\t%v: %v\n", path, err)
+			case changed:
+				fmt.Printf("\t%v\n", path)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			fmt.Println("can't walk " + dir)
+			os.Exit(3)
+		}
+	}
+}
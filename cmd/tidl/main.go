@@ -5,15 +5,48 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/trevorstarick/tidl"
 )
 
 var username, password string
 
-var onlyAlbums = flag.Bool("albums", false, "only download albums")
-var onlyEPs = flag.Bool("eps", false, "only download eps and singles")
+var dedupePolicy = flag.String("dedupe", "edition", "how to dedupe artist releases: title, edition, upc or all, followed by preferences e.g. edition,clean,hires")
+var explicit = flag.String("explicit", "either", "preferred version of releases: either, explicit or clean")
+var include = flag.String("include", "albums,eps", "artist releases to download: albums,eps,compilations,appearances")
+
+var videos = flag.Bool("videos", false, "also download music videos on albums")
+var videoResolution = flag.Int("resolution", 0, "preferred max video height, e.g. 1080 (default best)")
+
+var radio = flag.Bool("radio", false, "download the radio of a track or artist instead of the track or artist itself")
+
+var root = flag.String("root", "", "library root, defaults to the working directory")
+var output = flag.String("output", "", "album path template, e.g. {albumartist}/{year} - {album}/{discfolder}/{track:02} {title}")
+var playlistOutput = flag.String("playlist-output", "", "playlist path template, e.g. Playlists/{playlist}/{track:02} {artist} - {title}")
+
+var sanitize = flag.String("sanitize", "posix", "file name rules: posix, windows, fat32 or ascii")
+var maxNameBytes = flag.Int("max-name-bytes", tidl.DefaultMaxBytes, "max bytes per file or directory name")
+var suffixCollisions = flag.Bool("suffix-collisions", false, "save tracks whose paths collide with a \" (2)\" suffix instead of refusing the download")
+
+var artistSeparator = flag.String("artist-separator", ", ", "separator between joined artists")
+var artistLastSeparator = flag.String("artist-last-separator", " & ", "separator before the last joined artist")
+var feat = flag.String("feat", "none", "where featured artists go: none, title or artist")
+var multiArtist = flag.Bool("multi-artist", false, "write one ARTIST tag per artist instead of a joined one")
+
+var lyrics = flag.Bool("lyrics", false, "embed lyrics and write .lrc files next to tracks")
+
+var coverSize = flag.Int("cover-size", 1280, "largest embedded cover in pixels: 1280, 640, 320, 160 or 80")
+var maxPictureKB = flag.Int("max-picture-kb", 0, "cap on embedded picture size, smaller renditions are used to fit (default no cap)")
+var artistPicture = flag.Bool("artist-picture", false, "also embed the album artist's picture")
+
+var replayGain = flag.Bool("replaygain", false, "analyze loudness and write ReplayGain tags after each album")
+var albumImage = flag.Bool("album-image", false, "also join FLAC albums into one image with a cue sheet")
+var seekTable = flag.Duration("seektable", 0, "add a SEEKTABLE with a point this often, like 10s, to FLAC files that lack one (default none)")
+
+var playlistFormats = flag.String("playlist-files", "m3u8", "playlist files to write for albums and playlists: m3u8, xspf, pls or none")
+var playlistMode = flag.String("playlist-mode", "copy", "where playlist tracks go: copy, reuse (existing album copies), library, symlink or hardlink")
+
+var tagMerge = flag.String("tag-merge", "replace", "what to do with tags already in a stream: replace, keep or clear")
 
 var altUsername = flag.String("username", "", "optional username when not set in build process")
 var altPassword = flag.String("password", "", "optional password when not set in build process")
@@ -23,6 +56,16 @@ func main() {
 
 	flag.Parse()
 
+	// subcommands that only work on local files don't need a login
+	switch flag.Arg(0) {
+	case "replaygain":
+		runReplayGain(flag.Args()[1:])
+		return
+	case "seektable":
+		runSeekTable(flag.Args()[1:])
+		return
+	}
+
 	// TODO(TS): look into input prompt
 	if username == "" {
 		username = *altUsername
@@ -41,12 +84,123 @@ func main() {
 		os.Exit(1)
 	}
 
+	kinds, err := tidl.ParseReleaseKinds(*include)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dedupe, err := tidl.ParseDedupePolicy(*dedupePolicy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	explicitness, err := tidl.ParseExplicitness(*explicit)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	dedupe = tidl.ExplicitDedupe(dedupe, explicitness)
+
+	mergePolicy, err := tidl.ParseMergePolicy(*tagMerge)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	formats, err := tidl.ParsePlaylistFormats(*playlistFormats)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	mode, err := tidl.ParsePlaylistMode(*playlistMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var albumTemplate, playlistTemplate *tidl.Template
+	if *output != "" {
+		albumTemplate, err = tidl.ParseTemplate(*output)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *playlistOutput != "" {
+		playlistTemplate, err = tidl.ParseTemplate(*playlistOutput)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	profile, err := tidl.ParseSanitizeProfile(*sanitize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *maxNameBytes < tidl.MinMaxBytes {
+		fmt.Printf("-max-name-bytes must be at least %v\n", tidl.MinMaxBytes)
+		os.Exit(1)
+	}
+
+	featMode, err := tidl.ParseFeatMode(*feat)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	t, err := tidl.New(username, password)
 	if err != nil {
 		fmt.Println("can't login to tidl right now")
 		os.Exit(4)
 	}
 
+	t.DownloadVideos = *videos
+	t.VideoResolution = *videoResolution
+	t.Explicitness = explicitness
+	t.Root = *root
+	t.Lyrics = *lyrics
+	t.CoverSize = *coverSize
+	t.MaxPictureBytes = *maxPictureKB * 1024
+	t.ArtistPicture = *artistPicture
+	t.TagMerge = mergePolicy
+	t.ReplayGain = *replayGain
+	t.AlbumImage = *albumImage
+	t.SeekTable = *seekTable
+	t.PlaylistFormats = formats
+	t.PlaylistMode = mode
+	t.Sanitizer = tidl.Sanitizer{Profile: profile, MaxBytes: *maxNameBytes}
+	t.ArtistFormat = tidl.ArtistFormat{
+		Separator:     *artistSeparator,
+		LastSeparator: *artistLastSeparator,
+		Feat:          featMode,
+		MultiValue:    *multiArtist,
+	}
+	t.AlbumTemplate = albumTemplate
+	t.PlaylistTemplate = playlistTemplate
+	t.SuffixCollisions = *suffixCollisions
+
+	switch flag.Arg(0) {
+	case "artist":
+		runArtist(t, flag.Args()[1:])
+		return
+	case "lyrics":
+		runLyrics(t, flag.Args()[1:])
+		return
+	case "retag":
+		runRetag(t, flag.Args()[1:])
+		return
+	case "sync":
+		runSync(t, flag.Args()[1:])
+		return
+	}
+
 	var ids []string
 
 	// TODO(ts): handle output better
@@ -76,13 +230,62 @@ func main() {
 	}
 
 	for _, id := range ids {
-		splitIDs := strings.Split(strings.TrimSuffix(id, "/"), "/")
-		id = splitIDs[len(splitIDs) - 1]
+		ref, err := tidl.ParseRef(id)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		id = ref.ID
+
+		if *radio {
+			var tracks []tidl.Track
+			var title, mixType string
 
-		id = strings.Split(id, "#")[0]
-		id = strings.Split(id, "?")[0]
+			switch ref.Type {
+			case tidl.RefTrack:
+				var tr tidl.Track
+				tr, err = t.GetTrack(id)
+				if err != nil {
+					fmt.Println("can't get track info: " + id)
+					os.Exit(6)
+				}
 
-		if strings.Contains(id, "-") {
+				title = tr.Artist.Name + " - " + tr.Title + " Radio"
+				mixType = tidl.MixTrackRadio
+				tracks, err = t.GetTrackRadio(id, 0)
+			case tidl.RefArtist:
+				var artist tidl.Artist
+				artist, err = t.GetArtist(id)
+				if err != nil {
+					fmt.Println("can't get artist info")
+					os.Exit(5)
+				}
+
+				title = artist.Name + " Radio"
+				mixType = tidl.MixArtistRadio
+				tracks, err = t.GetArtistRadio(id, 0)
+			default:
+				fmt.Println("radio needs a track or artist: " + ref.String())
+				continue
+			}
+
+			if err != nil {
+				fmt.Println("can't get radio: " + id)
+				os.Exit(6)
+			}
+
+			fmt.Printf("[%v] %v\n", ref, title)
+			if err := t.DownloadMix(tidl.Mix{ID: id, Title: title, MixType: mixType, Tracks: tracks}); err != nil {
+				fmt.Println("can't download radio")
+				os.Exit(8)
+			}
+
+			continue
+		}
+
+		switch ref.Type {
+		case tidl.RefPlaylist:
 			p, err := t.GetPlaylist(id)
 			if err != nil {
 				panic(err)
@@ -99,59 +302,74 @@ func main() {
 			if err != nil {
 				panic(err)
 			}
-			
+
+			continue
+		case tidl.RefTrack:
+			tr, err := t.GetTrack(id)
+			if err != nil {
+				fmt.Println("can't get track info: " + id)
+				os.Exit(6)
+			}
+
+			fmt.Printf("[%v] %v - %v\n", tr.ID, tr.Artist.Name, tr.Title)
+			if err := t.DownloadAlbumTrack(tr); err != nil {
+				fmt.Println("can't download track")
+				os.Exit(8)
+			}
+
+			continue
+		case tidl.RefVideo:
+			v, err := t.GetVideo(id)
+			if err != nil {
+				fmt.Println("can't get video info: " + id)
+				os.Exit(6)
+			}
+
+			fmt.Printf("[%v] %v - %v\n", v.ID, v.Artist.Name, v.Title)
+			if err := t.DownloadVideo(v); err != nil {
+				fmt.Println("can't download video")
+				os.Exit(8)
+			}
+
+			continue
+		case tidl.RefMix:
+			m, err := t.GetMix(id)
+			if err != nil {
+				fmt.Println("can't get mix info: " + id)
+				os.Exit(6)
+			}
+
+			fmt.Printf("[%v] %v\n", m.ID, m.Title)
+			if err := t.DownloadMix(m); err != nil {
+				fmt.Println("can't download mix")
+				os.Exit(8)
+			}
+
 			continue
 		}
-		
 
 		var albums []tidl.Album
 
-		// TODO(ts): support fetching of EP/Singles as well as flags to disable
 		// TODO(ts): support fetching of artist info
-		artist, err := t.GetArtist(id)
-		if err != nil {
-			fmt.Println("can't get artist info")
-			os.Exit(5)
+		var artist tidl.Artist
+
+		// bare ids could be either an artist or an album, so probe the api
+		if ref.Type == tidl.RefArtist || ref.Type == tidl.RefUnknown {
+			artist, err = t.GetArtist(id)
+			if err != nil {
+				fmt.Println("can't get artist info")
+				os.Exit(5)
+			}
 		}
 
 		if artist.ID.String() != "" {
 			fmt.Printf("Downloading %v (%v)...\n", artist.Name, artist.ID)
 
-			if *onlyAlbums == true {
-				fmt.Println("Only fetching Albums")
-				lbums, err := t.GetArtistAlbums(id, 0)
-				if err != nil {
-					fmt.Println("can't get artist albums")
-					os.Exit(5)
-				}
-
-				albums = append(albums, lbums...)
-			} else if *onlyEPs {
-				fmt.Println("Only fetching EPs & Singles")
-				lbums, err := t.GetArtistEP(id, 0)
-				if err != nil {
-					fmt.Println("can't get artist eps")
-					os.Exit(5)
-				}
-
-				albums = append(albums, lbums...)
-			} else {
-				fmt.Println("Fetching Albums, EPs & Singles")
-				lbums, err := t.GetArtistAlbums(id, 0)
-				if err != nil {
-					fmt.Println("can't get artist albums")
-					os.Exit(5)
-				}
-
-				albums = append(albums, lbums...)
-
-				lbums, err = t.GetArtistEP(id, 0)
-				if err != nil {
-					fmt.Println("can't get artist eps")
-					os.Exit(5)
-				}
-
-				albums = append(albums, lbums...)
+			fmt.Printf("Fetching %v\n", *include)
+			albums, err = t.GetArtistDiscography(id, kinds...)
+			if err != nil {
+				fmt.Println("can't get artist releases")
+				os.Exit(5)
 			}
 		} else {
 			album, err := t.GetAlbum(id)
@@ -163,32 +381,15 @@ func main() {
 			albums = []tidl.Album{album}
 		}
 
-		albumMap := make(map[string]tidl.Album)
-		for _, album := range albums {
-			if _, ok := albumMap[album.Title]; !ok {
-				albumMap[album.Title] = album
-			} else {
-				// TODO(ts): impove dedupe if statement
-
-				if album.AudioQuality == "LOSSLESS" && albumMap[album.Title].AudioQuality != "LOSSLESS" {
-					// if higher quality
-					albumMap[album.Title] = album
-				} else if album.Explicit && !albumMap[album.Title].Explicit {
-					// if explicit
-					albumMap[album.Title] = album
-				} else if album.Popularity > albumMap[album.Title].Popularity {
-					// if more popular
-					albumMap[album.Title] = album
-				}
-			}
-		}
+		albums = dedupe.Dedupe(albums)
 
-		albums = make([]tidl.Album, 0, len(albumMap))
-		for _, album := range albumMap {
+		available := albums[:0]
+		for _, album := range albums {
 			if album.Duration > 0 {
-				albums = append(albums, album)
+				available = append(available, album)
 			}
 		}
+		albums = available
 
 		for _, album := range albums {
 			fmt.Printf("[%v] %v - %v\n", album.ID.String(), album.Artist.Name, album.Title)
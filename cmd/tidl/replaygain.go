@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// replaygain <dir>
+func runReplayGain(args []string) {
+	fs := flag.NewFlagSet("replaygain", flag.ExitOnError)
+
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Println("usage: tidl replaygain <dir>")
+		os.Exit(1)
+	}
+
+	for _, dir := range args {
+		err := tidl.WriteReplayGainTree(dir, func(paths []string, err error) {
+			if err != nil {
+				fmt.Printf("\t%v: %v\n", filepath.Dir(paths[0]), err)
+				return
+			}
+
+			fmt.Printf("\t%v (%v tracks)\n", filepath.Dir(paths[0]), len(paths))
+		})
+
+		if err != nil {
+			fmt.Println("can't walk " + dir)
+			os.Exit(3)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// retag [--dry-run] <dir>
+func runRetag(t *tidl.Tidal, args []string) {
+	fs := flag.NewFlagSet("retag", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only show what would change")
+
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Println("usage: tidl retag [--dry-run] <dir>")
+		os.Exit(1)
+	}
+
+	for _, dir := range args {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || !retaggable(path) || tidl.IsAlbumImage(path) {
+				return nil
+			}
+
+			before, after, err := t.Retag(path, *dryRun)
+			if err != nil {
+				fmt.Printf("\t%v: %v\n", path, err)
+				return nil
+			}
+
+			diff := tidl.DiffTags(before, after)
+			if len(diff) == 0 {
+				return nil
+			}
+
+			fmt.Printf("\t%v\n", path)
+			if *dryRun {
+				for _, line := range diff {
+					fmt.Printf("\t\t%v\n", shorten(line, 100))
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			fmt.Println("can't walk " + dir)
+			os.Exit(3)
+		}
+	}
+}
+
+func retaggable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac", ".m4a", ".mp4":
+		return true
+	}
+
+	return false
+}
+
+// shorten puts a value on one line and cuts it to at most n runes
+func shorten(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+
+	return s
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// seektable [--spacing 10s] <dir>
+func runSeekTable(args []string) {
+	fs := flag.NewFlagSet("seektable", flag.ExitOnError)
+	spacing := fs.Duration("spacing", tidl.DefaultSeekSpacing, "time between seek points")
+
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Println("usage: tidl seektable [--spacing 10s] <dir>")
+		os.Exit(1)
+	}
+
+	for _, dir := range args {
+		err := tidl.WriteSeekTableTree(dir, *spacing, func(path string, err error) {
+			if err != nil {
+				fmt.Printf("\t%v: %v\n", path, err)
+				return
+			}
+
+			fmt.Printf("\t%v\n", path)
+		})
+
+		if err != nil {
+			fmt.Println("can't walk " + dir)
+			os.Exit(3)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/trevorstarick/tidl"
+)
+
+// sync [--archive] playlist <id>...
+func runSync(t *tidl.Tidal, args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	archive := fs.Bool("archive", false, "move dropped tracks into .archive instead of deleting them")
+
+	args = parseInterspersed(fs, args)
+	if len(args) > 0 && args[0] == "playlist" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		fmt.Println("usage: tidl sync [--archive] playlist <id>...")
+		os.Exit(1)
+	}
+
+	for _, arg := range args {
+		ref, err := tidl.ParseRef(arg)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if ref.Type != tidl.RefPlaylist {
+			fmt.Println("only playlists can be synced: " + ref.String())
+			continue
+		}
+
+		p, err := t.GetPlaylist(ref.ID)
+		if err != nil {
+			fmt.Println("can't get playlist info: " + ref.ID)
+			os.Exit(5)
+		}
+
+		fmt.Printf("[%v] %v\n", p.ID, p.Title)
+
+		changes, err := t.SyncPlaylist(p, *archive)
+		for _, change := range changes {
+			fmt.Printf("\t%v\n", change)
+		}
+
+		if err != nil {
+			fmt.Printf("\tcan't sync playlist: %v\n", err)
+			continue
+		}
+
+		if len(changes) == 0 {
+			fmt.Println("\tup to date")
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package tidl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Contributor struct
+type Contributor struct {
+	ID   json.Number `json:"id"`
+	Name string      `json:"name"`
+}
+
+// Credit is a role on a track and the people credited for it
+type Credit struct {
+	Type         string        `json:"type"`
+	Contributors []Contributor `json:"contributors"`
+}
+
+// GetTrackCredits func
+func (t *Tidal) GetTrackCredits(id string) ([]Credit, error) {
+	var s []Credit
+	return s, t.get("tracks/"+id+"/credits", &url.Values{
+		"includeContributors": {"true"},
+	}, &s)
+}
+
+// GetAlbumCredits returns the credits of every track on an album, keyed by
+// track id, a page of tracks per request
+func (t *Tidal) GetAlbumCredits(id string) (map[string][]Credit, error) {
+	credits := make(map[string][]Credit)
+
+	err := t.getPages("albums/"+id+"/items/credits", url.Values{
+		"replace":             {"true"},
+		"includeContributors": {"true"},
+	}, func(raw json.RawMessage) error {
+		var item struct {
+			Item    Track    `json:"item"`
+			Credits []Credit `json:"credits"`
+		}
+
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return err
+		}
+
+		credits[item.Item.ID.String()] = item.Credits
+		return nil
+	})
+
+	return credits, err
+}
+
+// creditTags maps tidal credit types to vorbis comment fields, anything not
+// listed is a performer
+//
+// https://wiki.hydrogenaud.io/index.php?title=Tag_Mapping
+var creditTags = map[string]string{
+	"composer":              "COMPOSER",
+	"lyricist":              "LYRICIST",
+	"writer":                "WRITER",
+	"songwriter":            "WRITER",
+	"producer":              "PRODUCER",
+	"co-producer":           "PRODUCER",
+	"additional production": "PRODUCER",
+	"executive producer":    "PRODUCER",
+	"engineer":              "ENGINEER",
+	"recording engineer":    "ENGINEER",
+	"assistant engineer":    "ENGINEER",
+	"mastering engineer":    "ENGINEER",
+	"mixer":                 "MIXER",
+	"mixing engineer":       "MIXER",
+	"arranger":              "ARRANGER",
+	"conductor":             "CONDUCTOR",
+	"remixer":               "REMIXER",
+	"record label":          "LABEL",
+	"label":                 "LABEL",
+	"publisher":             "PUBLISHER",
+	"main artist":           "",
+	"featured artist":       "",
+}
+
+// label returns the record label credited on the track, if any
+func (tr Track) label() string {
+	for _, credit := range tr.Credits {
+		if creditTags[strings.ToLower(credit.Type)] == "LABEL" && len(credit.Contributors) > 0 {
+			return credit.Contributors[0].Name
+		}
+	}
+
+	return tr.Album.Label
+}
+
+// metadataTags returns the release and credit tags of the track. There's no
+// GENRE: the api has genres to browse by but none on albums or tracks, so
+// files only have one when it was already there.
+func (tr Track) metadataTags() [][2]string {
+	var tags [][2]string
+	add := func(key, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			tags = append(tags, [2]string{key, value})
+		}
+	}
+
+	add("TIDAL_TRACK_ID", tr.ID.String())
+	add("ISRC", tr.ISRC)
+	add("BARCODE", tr.Album.UPC)
+	add("LABEL", tr.label())
+	add("DATE", tr.Album.ReleaseDate)
+	add("VERSION", tr.Version)
+
+	if tr.BPM > 0 {
+		add("BPM", strconv.Itoa(tr.BPM))
+	}
+
+	if tr.Key != "" {
+		key := tr.Key
+		if strings.EqualFold(tr.KeyScale, "MINOR") {
+			key += "m"
+		}
+		add("KEY", key)
+	}
+
+	seen := make(map[[2]string]bool)
+	for _, credit := range tr.Credits {
+		field, known := creditTags[strings.ToLower(credit.Type)]
+		if known && (field == "" || field == "LABEL") {
+			continue
+		}
+
+		for _, contributor := range credit.Contributors {
+			tag := [2]string{field, contributor.Name}
+			if !known {
+				tag = [2]string{"PERFORMER", fmt.Sprintf("%v (%v)", contributor.Name, strings.ToLower(credit.Type))}
+			}
+
+			if !seen[tag] {
+				seen[tag] = true
+				add(tag[0], tag[1])
+			}
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,295 @@
+package tidl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DedupePolicy decides which releases of a discography are kept
+type DedupePolicy interface {
+	Dedupe(albums []Album) []Album
+}
+
+// Preference compares two releases of the same edition, returning a positive
+// number when a should be kept over b, negative for b and 0 when it can't tell
+type Preference func(a, b Album) int
+
+// EditionPolicy groups releases by Key and keeps the preferred release of
+// each group. Groups are returned in the order they were first seen and ties
+// left after Prefer fall back to the lowest id, so the result is stable.
+type EditionPolicy struct {
+	Key    func(Album) string
+	Prefer []Preference
+}
+
+// Dedupe implements DedupePolicy
+func (p EditionPolicy) Dedupe(albums []Album) []Album {
+	var order []string
+	best := make(map[string]Album)
+
+	for _, al := range albums {
+		key := p.Key(al)
+
+		cur, ok := best[key]
+		if !ok {
+			order = append(order, key)
+			best[key] = al
+			continue
+		}
+
+		if p.prefer(al, cur) {
+			best[key] = al
+		}
+	}
+
+	out := make([]Album, 0, len(order))
+	for _, key := range order {
+		out = append(out, best[key])
+	}
+
+	return out
+}
+
+func (p EditionPolicy) prefer(a, b Album) bool {
+	for _, pref := range p.Prefer {
+		if n := pref(a, b); n != 0 {
+			return n > 0
+		}
+	}
+
+	ai, _ := strconv.ParseInt(a.ID.String(), 10, 64)
+	bi, _ := strconv.ParseInt(b.ID.String(), 10, 64)
+	return ai < bi
+}
+
+// KeepAllEditions only drops releases listed more than once
+type KeepAllEditions struct{}
+
+// Dedupe implements DedupePolicy
+func (KeepAllEditions) Dedupe(albums []Album) []Album {
+	var out []Album
+	seen := make(map[string]bool)
+
+	for _, al := range albums {
+		if seen[al.ID.String()] {
+			continue
+		}
+
+		seen[al.ID.String()] = true
+		out = append(out, al)
+	}
+
+	return out
+}
+
+var (
+	// DedupeTitle is the old behaviour, one release per exact title
+	DedupeTitle = EditionPolicy{
+		Key:    TitleKey,
+		Prefer: []Preference{PreferLossless, PreferExplicit, PreferPopular},
+	}
+
+	// DedupeEdition keeps one release per edition, deluxe and remastered
+	// editions or releases with a different track count are kept apart
+	DedupeEdition = EditionPolicy{
+		Key:    EditionKey,
+		Prefer: []Preference{PreferHiRes, PreferExplicit, PreferPopular},
+	}
+
+	// DedupeUPC only collapses releases sharing a barcode
+	DedupeUPC = EditionPolicy{
+		Key:    UPCKey,
+		Prefer: []Preference{PreferHiRes, PreferExplicit, PreferPopular},
+	}
+
+	// DedupeNone keeps every edition
+	DedupeNone DedupePolicy = KeepAllEditions{}
+)
+
+// ParseDedupePolicy parses a comma separated policy, the first item picks the
+// grouping (title, edition, upc or all) and the rest are preferences applied in
+// order (hires, lossless, explicit, clean, popular, tracks), e.g.
+// "edition,clean,hires"
+func ParseDedupePolicy(s string) (DedupePolicy, error) {
+	parts := strings.Split(s, ",")
+
+	var policy EditionPolicy
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "title":
+		policy = DedupeTitle
+	case "", "edition":
+		policy = DedupeEdition
+	case "upc":
+		policy = DedupeUPC
+	case "all", "none":
+		return DedupeNone, nil
+	default:
+		return nil, fmt.Errorf("unknown dedupe policy: %q", parts[0])
+	}
+
+	if len(parts) == 1 {
+		return policy, nil
+	}
+
+	policy.Prefer = nil
+	for _, part := range parts[1:] {
+		switch strings.ToLower(strings.TrimSpace(part)) {
+		case "hires":
+			policy.Prefer = append(policy.Prefer, PreferHiRes)
+		case "lossless":
+			policy.Prefer = append(policy.Prefer, PreferLossless)
+		case "explicit":
+			policy.Prefer = append(policy.Prefer, PreferExplicit)
+		case "clean":
+			policy.Prefer = append(policy.Prefer, PreferClean)
+		case "popular":
+			policy.Prefer = append(policy.Prefer, PreferPopular)
+		case "tracks":
+			policy.Prefer = append(policy.Prefer, PreferMoreTracks)
+		default:
+			return nil, fmt.Errorf("unknown dedupe preference: %q", part)
+		}
+	}
+
+	return policy, nil
+}
+
+// ExplicitDedupe puts the version e asks for ahead of the preferences of an
+// EditionPolicy, so dedupe keeps the version PreferredAlbum would pick. Other
+// policies are returned as they are, and so is p for ExplicitEither.
+func ExplicitDedupe(p DedupePolicy, e Explicitness) DedupePolicy {
+	policy, ok := p.(EditionPolicy)
+	pref := e.preference()
+	if !ok || pref == nil {
+		return p
+	}
+
+	policy.Prefer = append([]Preference{pref}, policy.Prefer...)
+	return policy
+}
+
+// TitleKey groups by exact title
+func TitleKey(al Album) string {
+	return al.Title
+}
+
+// EditionKey groups by normalized title, version and track count
+func EditionKey(al Album) string {
+	return NormalizeTitle(al.Title) + "\x00" + NormalizeTitle(al.Version) + "\x00" + al.NumberOfTracks.String()
+}
+
+// UPCKey groups by barcode, releases without one are never collapsed
+func UPCKey(al Album) string {
+	if al.UPC == "" {
+		return "id:" + al.ID.String()
+	}
+
+	return strings.TrimLeft(al.UPC, "0")
+}
+
+// markers tidal (or the label) put in titles that don't make a different edition
+var advisoryMarker = regexp.MustCompile(`(?i)\s*[\(\[]\s*(explicit|clean|edited|explicit version|clean version)\s*[\)\]]`)
+
+// NormalizeTitle folds case, quotes, dashes and whitespace and strips
+// explicit/clean markers, so "Album (Explicit)" and "album" compare equal
+func NormalizeTitle(s string) string {
+	s = advisoryMarker.ReplaceAllString(s, "")
+
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '‘', '’', '`', '´':
+			return '\''
+		case '“', '”':
+			return '"'
+		case '‐', '‑', '‒', '–', '—':
+			return '-'
+		}
+
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+
+		return unicode.ToLower(r)
+	}, s)
+
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// qualityRank orders tidal's audio qualities
+func qualityRank(al Album) int {
+	for _, tag := range al.MediaMetadata.Tags {
+		if tag == "HIRES_LOSSLESS" {
+			return 4
+		}
+	}
+
+	switch al.AudioQuality {
+	case "HI_RES_LOSSLESS":
+		return 4
+	case "HI_RES":
+		return 3
+	case "LOSSLESS":
+		return 2
+	case "HIGH":
+		return 1
+	}
+
+	return 0
+}
+
+// PreferHiRes prefers the release with the best audio quality
+func PreferHiRes(a, b Album) int {
+	return qualityRank(a) - qualityRank(b)
+}
+
+// PreferLossless prefers lossless over lossy but doesn't tell lossless
+// releases apart
+func PreferLossless(a, b Album) int {
+	lossless := func(al Album) int {
+		if qualityRank(al) >= 2 {
+			return 1
+		}
+		return 0
+	}
+
+	return lossless(a) - lossless(b)
+}
+
+// PreferExplicit prefers explicit releases
+func PreferExplicit(a, b Album) int {
+	return boolRank(a.Explicit) - boolRank(b.Explicit)
+}
+
+// PreferClean prefers clean releases
+func PreferClean(a, b Album) int {
+	return boolRank(b.Explicit) - boolRank(a.Explicit)
+}
+
+// PreferPopular prefers the more popular release
+func PreferPopular(a, b Album) int {
+	switch {
+	case a.Popularity > b.Popularity:
+		return 1
+	case a.Popularity < b.Popularity:
+		return -1
+	}
+
+	return 0
+}
+
+// PreferMoreTracks prefers the release with more tracks
+func PreferMoreTracks(a, b Album) int {
+	an, _ := a.NumberOfTracks.Int64()
+	bn, _ := b.NumberOfTracks.Int64()
+	return int(an - bn)
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
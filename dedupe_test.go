@@ -0,0 +1,233 @@
+package tidl
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func testRelease(id, title string, tracks int, opts ...func(*Album)) Album {
+	al := Album{
+		ID:             json.Number(id),
+		Title:          title,
+		NumberOfTracks: json.Number(fmt.Sprint(tracks)),
+		AudioQuality:   "LOSSLESS",
+	}
+
+	for _, opt := range opts {
+		opt(&al)
+	}
+
+	return al
+}
+
+func explicit(al *Album) { al.Explicit = true }
+func hiRes(al *Album)    { al.MediaMetadata.Tags = []string{"LOSSLESS", "HIRES_LOSSLESS"} }
+
+func upc(code string) func(*Album) {
+	return func(al *Album) { al.UPC = code }
+}
+
+func version(v string) func(*Album) {
+	return func(al *Album) { al.Version = v }
+}
+
+func popularity(p float64) func(*Album) {
+	return func(al *Album) { al.Popularity = p }
+}
+
+func albumIDs(albums []Album) []string {
+	var ids []string
+	for _, al := range albums {
+		ids = append(ids, al.ID.String())
+	}
+	return ids
+}
+
+func sortedStrings(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy DedupePolicy
+		albums []Album
+		want   []string
+	}{
+		{
+			"deluxe and standard are different editions",
+			DedupeEdition,
+			[]Album{
+				testRelease("1", "Album", 10),
+				testRelease("2", "Album", 14, version("Deluxe Edition")),
+				testRelease("3", "Album (Deluxe)", 14),
+			},
+			[]string{"1", "2", "3"},
+		},
+		{
+			"deluxe collapses under title",
+			DedupeTitle,
+			[]Album{
+				testRelease("1", "Album", 10),
+				testRelease("2", "Album", 14, version("Deluxe Edition")),
+			},
+			[]string{"1"},
+		},
+		{
+			"explicit and clean twins keep the explicit one",
+			DedupeEdition,
+			[]Album{
+				testRelease("1", "Album (Clean)", 10),
+				testRelease("2", "Album [Explicit]", 10, explicit),
+				testRelease("3", "Other", 8),
+			},
+			[]string{"2", "3"},
+		},
+		{
+			"explicit and clean twins keep the clean one when asked",
+			EditionPolicy{Key: EditionKey, Prefer: []Preference{PreferClean}},
+			[]Album{
+				testRelease("1", "Album", 10, explicit),
+				testRelease("2", "Album (Clean Version)", 10),
+			},
+			[]string{"2"},
+		},
+		{
+			"same upc under different ids",
+			DedupeUPC,
+			[]Album{
+				testRelease("5", "Album", 10, upc("0602435")),
+				testRelease("3", "Album (Remastered)", 11, upc("602435")),
+				testRelease("4", "Album", 10, upc("111")),
+			},
+			[]string{"3", "4"},
+		},
+		{
+			"releases without a upc are never collapsed",
+			DedupeUPC,
+			[]Album{
+				testRelease("1", "Album", 10),
+				testRelease("2", "Album", 10),
+			},
+			[]string{"1", "2"},
+		},
+		{
+			"hi-res beats lossless",
+			DedupeEdition,
+			[]Album{
+				testRelease("1", "Album", 10, popularity(90)),
+				testRelease("2", "Album", 10, hiRes),
+			},
+			[]string{"2"},
+		},
+		{
+			"lossless doesn't tell hi-res apart under title",
+			DedupeTitle,
+			[]Album{
+				testRelease("1", "Album", 10, hiRes),
+				testRelease("2", "Album", 10, popularity(90)),
+			},
+			[]string{"2"},
+		},
+		{
+			"ties fall back to the lowest id",
+			DedupeEdition,
+			[]Album{
+				testRelease("30", "Album", 10),
+				testRelease("4", "Album", 10),
+				testRelease("100", "Album", 10),
+			},
+			[]string{"4"},
+		},
+		{
+			"none keeps editions and drops repeated ids",
+			DedupeNone,
+			[]Album{
+				testRelease("1", "Album", 10),
+				testRelease("2", "Album", 10),
+				testRelease("1", "Album", 10),
+			},
+			[]string{"1", "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := albumIDs(tt.policy.Dedupe(tt.albums))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		// which releases survive doesn't depend on the order they're listed
+		// in, only the order of the groups does
+		reversed := make([]Album, len(tt.albums))
+		for i, al := range tt.albums {
+			reversed[len(reversed)-1-i] = al
+		}
+
+		got = albumIDs(tt.policy.Dedupe(reversed))
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(sortedStrings(tt.want)) {
+			t.Errorf("%v reversed: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := map[string]string{
+		"Album (Explicit)":              "album",
+		"Album [Clean]":                 "album",
+		"Album (explicit version)":      "album",
+		"Album ( Clean Version )":       "album",
+		"Album [Edited]":                "album",
+		"Album (Deluxe) [Explicit]":     "album (deluxe)",
+		"Don’t  Stop – Live":            "don't stop - live",
+		"“Quoted”\tTitle":               "\"quoted\" title",
+		"Explicit Content":              "explicit content",
+		"The Clean Sessions (Explicit)": "the clean sessions",
+	}
+
+	for in, want := range tests {
+		if got := NormalizeTitle(in); got != want {
+			t.Errorf("NormalizeTitle(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseDedupePolicy(t *testing.T) {
+	albums := []Album{
+		testRelease("1", "Album", 10, explicit, hiRes),
+		testRelease("2", "Album", 10),
+	}
+
+	tests := map[string]string{
+		"":                "[1]",
+		"edition":         "[1]",
+		"edition,clean":   "[2]",
+		"title,clean":     "[2]",
+		"upc":             "[1 2]",
+		"all":             "[1 2]",
+		"EDITION, Clean ": "[2]",
+	}
+
+	for in, want := range tests {
+		policy, err := ParseDedupePolicy(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+
+		if got := fmt.Sprint(albumIDs(policy.Dedupe(albums))); got != want {
+			t.Errorf("%q: got %v, want %v", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"bogus", "edition,bogus"} {
+		if _, err := ParseDedupePolicy(in); err == nil {
+			t.Errorf("%q parsed", in)
+		}
+	}
+}
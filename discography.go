@@ -0,0 +1,150 @@
+package tidl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ReleaseKind selects a part of an artist's discography
+type ReleaseKind string
+
+const (
+	ReleaseAlbums       ReleaseKind = "albums"
+	ReleaseEPs          ReleaseKind = "eps"
+	ReleaseCompilations ReleaseKind = "compilations"
+	ReleaseAppearances  ReleaseKind = "appearances"
+)
+
+// DefaultReleaseKinds is what GetArtistDiscography fetches when no kinds are given
+var DefaultReleaseKinds = []ReleaseKind{ReleaseAlbums, ReleaseEPs}
+
+// ParseReleaseKinds parses a comma separated list like "albums,eps"
+func ParseReleaseKinds(s string) ([]ReleaseKind, error) {
+	var kinds []ReleaseKind
+
+	for _, part := range strings.Split(s, ",") {
+		switch kind := ReleaseKind(strings.ToLower(strings.TrimSpace(part))); kind {
+		case "":
+		case ReleaseAlbums, ReleaseEPs, ReleaseCompilations, ReleaseAppearances:
+			kinds = append(kinds, kind)
+		case "singles":
+			kinds = append(kinds, ReleaseEPs)
+		default:
+			return nil, fmt.Errorf("unknown release kind: %q", part)
+		}
+	}
+
+	return kinds, nil
+}
+
+// GetArtistCompilations returns compilations released by the artist
+func (t *Tidal) GetArtistCompilations(artist string, l int) ([]Album, error) {
+	albums, err := t.getArtistAlbums(artist, "COMPILATIONS", l)
+	return filterAlbums(albums, func(al Album) bool {
+		return al.Artist.ID.String() == artist
+	}), err
+}
+
+// GetArtistAppearances returns releases by other artists the artist appears
+// on. Tidal lists these under the COMPILATIONS filter together with the
+// artist's own compilations.
+func (t *Tidal) GetArtistAppearances(artist string, l int) ([]Album, error) {
+	albums, err := t.getArtistAlbums(artist, "COMPILATIONS", l)
+	return filterAlbums(albums, func(al Album) bool {
+		return al.Artist.ID.String() != artist
+	}), err
+}
+
+// GetArtistDiscography fetches the given kinds of releases, albums and eps
+// when none are given. Releases are returned once even if listed under
+// several kinds.
+func (t *Tidal) GetArtistDiscography(artist string, kinds ...ReleaseKind) ([]Album, error) {
+	if len(kinds) == 0 {
+		kinds = DefaultReleaseKinds
+	}
+
+	var out []Album
+	seen := make(map[string]bool)
+
+	for _, kind := range kinds {
+		var albums []Album
+		var err error
+
+		switch kind {
+		case ReleaseAlbums:
+			albums, err = t.GetArtistAlbums(artist, 0)
+		case ReleaseEPs:
+			albums, err = t.GetArtistEP(artist, 0)
+		case ReleaseCompilations:
+			albums, err = t.GetArtistCompilations(artist, 0)
+		case ReleaseAppearances:
+			albums, err = t.GetArtistAppearances(artist, 0)
+		default:
+			err = fmt.Errorf("unknown release kind: %q", kind)
+		}
+
+		if err != nil {
+			return out, err
+		}
+
+		for _, album := range albums {
+			if seen[album.ID.String()] {
+				continue
+			}
+
+			seen[album.ID.String()] = true
+			out = append(out, album)
+		}
+	}
+
+	return out, nil
+}
+
+// errEnoughAlbums stops getArtistAlbums paging once it has l albums
+var errEnoughAlbums = errors.New("enough albums")
+
+// getArtistAlbums pages through an artist's releases under filter, all of
+// them when l is 0
+func (t *Tidal) getArtistAlbums(artist, filter string, l int) ([]Album, error) {
+	var albums []Album
+
+	query := url.Values{}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+
+	err := t.getPages(fmt.Sprintf("artists/%s/albums", artist), query, func(raw json.RawMessage) error {
+		var album Album
+		if err := json.Unmarshal(raw, &album); err != nil {
+			return err
+		}
+
+		t.albumMap[album.ID.String()] = album
+		albums = append(albums, album)
+
+		if l > 0 && len(albums) >= l {
+			return errEnoughAlbums
+		}
+		return nil
+	})
+
+	if err == errEnoughAlbums {
+		err = nil
+	}
+
+	return albums, err
+}
+
+func filterAlbums(albums []Album, keep func(Album) bool) []Album {
+	var out []Album
+	for _, al := range albums {
+		if keep(al) {
+			out = append(out, al)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,45 @@
+package tidl
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetArtistAlbums(t *testing.T) {
+	n := pageSize*2 + 7
+	td := testAPI(t, pagedHandler(t, n))
+
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{0, n},
+		{5, 5},
+		{pageSize + 1, pageSize + 1},
+		{n + 10, n},
+	}
+
+	for _, tt := range tests {
+		albums, err := td.GetArtistAlbums("1", tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(albums) != tt.want {
+			t.Errorf("limit %v: got %v albums, want %v", tt.limit, len(albums), tt.want)
+			continue
+		}
+
+		for i, al := range albums {
+			if al.ID.String() != fmt.Sprint(i) {
+				t.Fatalf("limit %v: album %v has id %v", tt.limit, i, al.ID)
+			}
+		}
+	}
+
+	// albums and eps list the same ids here, they're only returned once
+	albums, err := td.GetArtistDiscography("1", ReleaseAlbums, ReleaseEPs)
+	if err != nil || len(albums) != n {
+		t.Errorf("got %v albums, %v", len(albums), err)
+	}
+}
@@ -0,0 +1,259 @@
+package tidl
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Explicitness is the preferred version when a release comes in both an
+// explicit and a clean version
+type Explicitness int
+
+const (
+	// ExplicitEither downloads whatever version was asked for
+	ExplicitEither Explicitness = iota
+	// ExplicitPreferred swaps clean versions for explicit ones when available
+	ExplicitPreferred
+	// CleanPreferred swaps explicit versions for clean ones when available
+	CleanPreferred
+)
+
+// ParseExplicitness parses "either", "explicit" or "clean"
+func ParseExplicitness(s string) (Explicitness, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "either", "any":
+		return ExplicitEither, nil
+	case "explicit":
+		return ExplicitPreferred, nil
+	case "clean":
+		return CleanPreferred, nil
+	}
+
+	return ExplicitEither, fmt.Errorf("unknown explicitness: %q", s)
+}
+
+// preference is the dedupe preference for the version e asks for, nil for
+// ExplicitEither
+func (e Explicitness) preference() Preference {
+	switch e {
+	case ExplicitPreferred:
+		return PreferExplicit
+	case CleanPreferred:
+		return PreferClean
+	}
+
+	return nil
+}
+
+func (e Explicitness) wants(explicit bool) bool {
+	switch e {
+	case ExplicitPreferred:
+		return explicit
+	case CleanPreferred:
+		return !explicit
+	}
+
+	return true
+}
+
+// GetTracksByISRC func
+func (t *Tidal) GetTracksByISRC(isrc string) ([]Track, error) {
+	var s struct {
+		Items []Track `json:"items"`
+	}
+
+	return s.Items, t.get("tracks", &url.Values{
+		"isrc": {isrc},
+	}, &s)
+}
+
+// PreferredAlbum returns the other version of al when it doesn't match the
+// client's Explicitness and an alternate exists, al otherwise. Versions are
+// found through the ISRC of al's first track, falling back to the artist's
+// discography, and only count when they share al's UPC or ISRCs.
+func (t *Tidal) PreferredAlbum(al Album) Album {
+	if t.Explicitness.wants(al.Explicit) {
+		return al
+	}
+
+	tracks, err := t.GetAlbumTracks(al.ID.String())
+	if err != nil {
+		return al
+	}
+
+	isrcs := make(map[string]bool)
+	for _, tr := range tracks {
+		if tr.ISRC != "" {
+			isrcs[tr.ISRC] = true
+		}
+	}
+
+	seen := map[string]bool{al.ID.String(): true}
+	try := func(id string) (Album, bool) {
+		if seen[id] {
+			return al, false
+		}
+
+		seen[id] = true
+		return t.alternateAlbum(al, id, isrcs)
+	}
+
+	// the other version usually carries the same recordings
+	for _, tr := range tracks {
+		if tr.ISRC == "" {
+			continue
+		}
+
+		alts, _ := t.GetTracksByISRC(tr.ISRC)
+		for _, alt := range alts {
+			if !t.Explicitness.wants(alt.Explicit) {
+				continue
+			}
+
+			if found, ok := try(alt.Album.ID.String()); ok {
+				return t.preferAlbum(found)
+			}
+		}
+		break
+	}
+
+	albums, err := t.artistDiscography(al.Artist.ID.String())
+	if err != nil {
+		return al
+	}
+
+	for _, alt := range albums {
+		if !t.Explicitness.wants(alt.Explicit) || NormalizeTitle(alt.Title) != NormalizeTitle(al.Title) {
+			continue
+		}
+
+		if found, ok := try(alt.ID.String()); ok {
+			return t.preferAlbum(found)
+		}
+	}
+
+	return al
+}
+
+// preferAlbum marks a found version as the one to download
+func (t *Tidal) preferAlbum(alt Album) Album {
+	alt.edited = !alt.Explicit
+	t.albumMap[alt.ID.String()] = alt
+	return alt
+}
+
+// artistDiscography is GetArtistDiscography with the default kinds, fetched
+// once per artist so looking up versions of a whole discography doesn't
+// fetch it again for every album
+func (t *Tidal) artistDiscography(artist string) ([]Album, error) {
+	if albums, ok := t.discographies[artist]; ok {
+		return albums, nil
+	}
+
+	albums, err := t.GetArtistDiscography(artist)
+	if err != nil {
+		return albums, err
+	}
+
+	if t.discographies == nil {
+		t.discographies = make(map[string][]Album)
+	}
+	t.discographies[artist] = albums
+
+	return albums, nil
+}
+
+// alternateAlbum fetches album id and reports whether it's another version of
+// al: same artist, version and track count, and the same UPC or at least one
+// of the ISRCs of al's tracks
+func (t *Tidal) alternateAlbum(al Album, id string, isrcs map[string]bool) (Album, bool) {
+	alt, err := t.getAlbumInfo(id)
+	if err != nil || !t.Explicitness.wants(alt.Explicit) {
+		return alt, false
+	}
+
+	if alt.Artist.ID != al.Artist.ID ||
+		alt.NumberOfTracks != al.NumberOfTracks ||
+		NormalizeTitle(alt.Version) != NormalizeTitle(al.Version) {
+		return alt, false
+	}
+
+	if al.UPC != "" && strings.TrimLeft(alt.UPC, "0") == strings.TrimLeft(al.UPC, "0") {
+		return alt, true
+	}
+
+	tracks, err := t.GetAlbumTracks(id)
+	if err != nil {
+		return alt, false
+	}
+
+	for _, tr := range tracks {
+		if isrcs[tr.ISRC] {
+			return alt, true
+		}
+	}
+
+	return alt, false
+}
+
+// PreferredTrack returns the other version of tr when it doesn't match the
+// client's Explicitness, looking it up by ISRC first and falling back to a
+// title search
+func (t *Tidal) PreferredTrack(tr Track) Track {
+	if t.Explicitness.wants(tr.Explicit) {
+		return tr
+	}
+
+	var candidates []Track
+	if tr.ISRC != "" {
+		candidates, _ = t.GetTracksByISRC(tr.ISRC)
+	}
+
+	if found, ok := t.pickAlternateTrack(tr, candidates); ok {
+		return found
+	}
+
+	candidates, err := t.SearchTracks(tr.Artist.Name+" "+tr.Title, 50)
+	if err != nil {
+		return tr
+	}
+
+	if found, ok := t.pickAlternateTrack(tr, candidates); ok {
+		return found
+	}
+
+	return tr
+}
+
+func (t *Tidal) pickAlternateTrack(tr Track, candidates []Track) (Track, bool) {
+	for _, alt := range candidates {
+		if alt.ID == tr.ID || !t.Explicitness.wants(alt.Explicit) {
+			continue
+		}
+
+		sameRecording := tr.ISRC != "" && alt.ISRC == tr.ISRC
+		sameSong := alt.Artist.ID == tr.Artist.ID && NormalizeTitle(alt.Title) == NormalizeTitle(tr.Title)
+		if !sameRecording && !sameSong {
+			continue
+		}
+
+		alt.edited = !alt.Explicit
+		return alt, true
+	}
+
+	return tr, false
+}
+
+// advisory returns the ITUNESADVISORY value for the track, 1 for explicit, 2
+// for a known clean version and "" when nothing is known
+func (tr Track) advisory() string {
+	switch {
+	case tr.Explicit:
+		return "1"
+	case tr.edited || tr.Album.edited:
+		return "2"
+	}
+
+	return ""
+}
@@ -0,0 +1,101 @@
+package tidl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExplicitDedupe(t *testing.T) {
+	albums := []Album{
+		testRelease("1", "Album", 10, explicit, hiRes),
+		testRelease("2", "Album", 10),
+	}
+
+	tests := []struct {
+		policy DedupePolicy
+		e      Explicitness
+		want   string
+	}{
+		{DedupeEdition, ExplicitEither, "[1]"},
+		{DedupeEdition, ExplicitPreferred, "[1]"},
+		{DedupeEdition, CleanPreferred, "[2]"},
+		{DedupeTitle, CleanPreferred, "[2]"},
+		{DedupeNone, CleanPreferred, "[1 2]"},
+	}
+
+	for i, tt := range tests {
+		if got := fmt.Sprint(albumIDs(ExplicitDedupe(tt.policy, tt.e).Dedupe(albums))); got != tt.want {
+			t.Errorf("%v: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+// versionAPI serves an artist with explicit albums and one clean version,
+// counting the requests made for each path
+func versionAPI(t *testing.T, requests map[string]int) *Tidal {
+	albums := []Album{
+		{ID: "1", Title: "Album", Explicit: true},
+		{ID: "2", Title: "Album (Clean)"},
+		{ID: "3", Title: "Other", Explicit: true},
+		{ID: "4", Title: "Third", Explicit: true},
+	}
+
+	// the clean version shares the first recording of album 1
+	isrcs := map[string]string{"1": "X1", "2": "X1", "3": "X3", "4": "X4"}
+
+	for i := range albums {
+		albums[i].Artist = Artist{ID: "9"}
+		albums[i].NumberOfTracks = "1"
+		albums[i].Duration = 100
+	}
+
+	return testAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		enc := json.NewEncoder(w)
+
+		switch parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); {
+		case r.URL.Path == "/v1/artists/9/albums":
+			enc.Encode(map[string]interface{}{"totalNumberOfItems": len(albums), "items": albums})
+		case len(parts) == 4 && parts[1] == "albums" && parts[3] == "tracks":
+			enc.Encode(map[string]interface{}{"items": []Track{{ID: "10", ISRC: isrcs[parts[2]]}}})
+		default:
+			// nothing found by ISRC, so the discography is searched
+			enc.Encode(map[string]interface{}{"items": []Track{}})
+		}
+	}))
+}
+
+func TestPreferredAlbum(t *testing.T) {
+	requests := make(map[string]int)
+	td := versionAPI(t, requests)
+	td.Explicitness = CleanPreferred
+
+	albums, err := td.GetArtistDiscography("9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"1": "2", "3": "3", "4": "4"}
+	for _, al := range albums {
+		if !al.Explicit {
+			continue
+		}
+
+		got := td.PreferredAlbum(al)
+		if got.ID.String() != want[al.ID.String()] {
+			t.Errorf("album %v: got %v, want %v", al.ID, got.ID, want[al.ID.String()])
+		}
+		if got.ID != al.ID && got.Explicit {
+			t.Errorf("album %v: got an explicit version", al.ID)
+		}
+	}
+
+	// one listing for albums and one for eps, shared by all three lookups
+	// and the discography fetched above
+	if n := requests["/v1/artists/9/albums"]; n != 4 {
+		t.Errorf("fetched the discography listing %v times, want 4", n)
+	}
+}
@@ -0,0 +1,451 @@
+package tidl
+
+import (
+	"errors"
+)
+
+// ErrSampleFormat is returned for audio the frame encoder can't describe in a
+// frame header
+var ErrSampleFormat = errors.New("unsupported sample format")
+
+// flacBlockSize is the number of samples per channel in each frame we write
+const flacBlockSize = 4096
+
+// subframe types
+const (
+	subframeConstant = iota
+	subframeVerbatim
+	subframeFixed
+)
+
+// highest fixed predictor order and rice partition order we try
+const (
+	maxFixedOrder     = 4
+	maxPartitionOrder = 8
+)
+
+// frame header codes for sample rates and sizes, anything else goes in the
+// header tail or isn't supported
+var (
+	sampleRateCodes = map[uint32]uint64{
+		88200: 0x1, 176400: 0x2, 192000: 0x3, 8000: 0x4, 16000: 0x5,
+		22050: 0x6, 24000: 0x7, 32000: 0x8, 44100: 0x9, 48000: 0xa, 96000: 0xb,
+	}
+	sampleSizeCodes = map[uint8]uint64{8: 0x1, 12: 0x2, 16: 0x4, 20: 0x5, 24: 0x6}
+)
+
+// channel assignments for stereo decorrelation
+const (
+	channelsLeftSide  = 0x8
+	channelsSideRight = 0x9
+	channelsMidSide   = 0xa
+)
+
+// bitWriter packs bits msb first
+type bitWriter struct {
+	buf  []byte
+	cur  byte
+	bits uint
+}
+
+// write writes the low n bits of v
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		free := 8 - w.bits
+		take := free
+		if n < take {
+			take = n
+		}
+
+		n -= take
+		w.cur |= byte((v>>n)&(1<<take-1)) << (free - take)
+		w.bits += take
+
+		if w.bits == 8 {
+			w.buf = append(w.buf, w.cur)
+			w.cur, w.bits = 0, 0
+		}
+	}
+}
+
+// unary writes q zeros and a one
+func (w *bitWriter) unary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		w.write(0, 32)
+	}
+	w.write(1, uint(q)+1)
+}
+
+func (w *bitWriter) align() {
+	if w.bits > 0 {
+		w.write(0, 8-w.bits)
+	}
+}
+
+var crc8Table, crc16Table = crcTables()
+
+// crcTables builds the CRC-8 (x^8+x^2+x+1) and CRC-16 (x^16+x^15+x^2+1)
+// tables frame headers and frames are checked with
+func crcTables() ([256]uint8, [256]uint16) {
+	var t8 [256]uint8
+	var t16 [256]uint16
+
+	for i := 0; i < 256; i++ {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		t8[i], t16[i] = c8, c16
+	}
+
+	return t8, t16
+}
+
+func crc8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc = crc8Table[crc^b]
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// utf8Number encodes a frame number the way frame headers store it
+func utf8Number(n uint64) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	k := 2
+	for n >= 1<<uint(5*k+1) {
+		k++
+	}
+
+	out := make([]byte, k)
+	for i := k - 1; i > 0; i-- {
+		out[i] = 0x80 | byte(n&0x3f)
+		n >>= 6
+	}
+	out[0] = byte(0xff<<uint(8-k)) | byte(n)
+
+	return out
+}
+
+// frameEncoder writes frames of a fixed block size stream. The vendored flac
+// package only decodes, this gets by with fixed predictors and rice coding,
+// nowhere near libFLAC -8 but lossless and plays everywhere.
+type frameEncoder struct {
+	sampleRate uint32
+	channels   int
+	bps        uint8
+
+	rateCode, rateTail uint64
+	rateTailBits       uint
+	sizeCode           uint64
+}
+
+func newFrameEncoder(sampleRate uint32, channels int, bps uint8) (*frameEncoder, error) {
+	e := &frameEncoder{sampleRate: sampleRate, channels: channels, bps: bps}
+
+	var ok bool
+	if e.sizeCode, ok = sampleSizeCodes[bps]; !ok || channels < 1 || channels > 8 {
+		return nil, ErrSampleFormat
+	}
+
+	switch code, ok := sampleRateCodes[sampleRate]; {
+	case ok:
+		e.rateCode = code
+	case sampleRate%1000 == 0 && sampleRate/1000 < 256:
+		e.rateCode, e.rateTail, e.rateTailBits = 0xc, uint64(sampleRate/1000), 8
+	case sampleRate < 1<<16:
+		e.rateCode, e.rateTail, e.rateTailBits = 0xd, uint64(sampleRate), 16
+	case sampleRate%10 == 0 && sampleRate/10 < 1<<16:
+		e.rateCode, e.rateTail, e.rateTailBits = 0xe, uint64(sampleRate/10), 16
+	}
+
+	return e, nil
+}
+
+// encode returns frame number num holding samples, one slice per channel
+func (e *frameEncoder) encode(num uint64, samples [][]int64) []byte {
+	n := len(samples[0])
+	channelCode := uint64(e.channels - 1)
+
+	subframes := samples
+	plans := make([]subframePlan, e.channels)
+	bps := make([]uint, e.channels)
+	for ch := range bps {
+		bps[ch] = uint(e.bps)
+	}
+
+	if e.channels == 2 {
+		// pick whichever of left/right, left/side, side/right and mid/side
+		// is smallest, side needs an extra bit
+		left, right := samples[0], samples[1]
+		mid := make([]int64, n)
+		side := make([]int64, n)
+		for i := range left {
+			mid[i] = (left[i] + right[i]) >> 1
+			side[i] = left[i] - right[i]
+		}
+
+		l := planSubframe(left, uint(e.bps))
+		r := planSubframe(right, uint(e.bps))
+		m := planSubframe(mid, uint(e.bps))
+		s := planSubframe(side, uint(e.bps)+1)
+
+		plans[0], plans[1] = l, r
+		best := l.bits + r.bits
+
+		if l.bits+s.bits < best {
+			best = l.bits + s.bits
+			channelCode, subframes, plans = channelsLeftSide, [][]int64{left, side}, []subframePlan{l, s}
+			bps = []uint{uint(e.bps), uint(e.bps) + 1}
+		}
+		if s.bits+r.bits < best {
+			best = s.bits + r.bits
+			channelCode, subframes, plans = channelsSideRight, [][]int64{side, right}, []subframePlan{s, r}
+			bps = []uint{uint(e.bps) + 1, uint(e.bps)}
+		}
+		if m.bits+s.bits < best {
+			channelCode, subframes, plans = channelsMidSide, [][]int64{mid, side}, []subframePlan{m, s}
+			bps = []uint{uint(e.bps), uint(e.bps) + 1}
+		}
+	} else {
+		for ch := range samples {
+			plans[ch] = planSubframe(samples[ch], uint(e.bps))
+		}
+	}
+
+	w := &bitWriter{}
+	w.write(0x3ffe, 14)
+	w.write(0, 1)
+	// fixed block size
+	w.write(0, 1)
+	// block size - 1 in 16 bits at the end of the header
+	w.write(0x7, 4)
+	w.write(e.rateCode, 4)
+	w.write(channelCode, 4)
+	w.write(e.sizeCode, 3)
+	w.write(0, 1)
+
+	for _, b := range utf8Number(num) {
+		w.write(uint64(b), 8)
+	}
+
+	w.write(uint64(n-1), 16)
+	w.write(e.rateTail, e.rateTailBits)
+	w.write(uint64(crc8(w.buf)), 8)
+
+	for ch, plan := range plans {
+		plan.write(w, subframes[ch], bps[ch])
+	}
+
+	w.align()
+	crc := crc16(w.buf)
+	return append(w.buf, byte(crc>>8), byte(crc))
+}
+
+// subframePlan is the cheapest way found to encode a subframe
+type subframePlan struct {
+	kind      int
+	order     int
+	partOrder int
+	params    []uint
+	bits      uint64
+}
+
+// planSubframe works out the cheapest encoding of samples at bps bits
+func planSubframe(samples []int64, bps uint) subframePlan {
+	n := len(samples)
+
+	constant := true
+	for _, x := range samples[1:] {
+		constant = constant && x == samples[0]
+	}
+
+	if constant {
+		return subframePlan{kind: subframeConstant, bits: 8 + uint64(bps)}
+	}
+
+	best := subframePlan{kind: subframeVerbatim, bits: 8 + uint64(n)*uint64(bps)}
+
+	residual := make([]int64, n)
+	for order := 0; order <= maxFixedOrder && order < n; order++ {
+		fixedResidual(samples, order, residual)
+
+		partOrder, params, bits := planRice(residual, order)
+		bits += 8 + uint64(order)*uint64(bps)
+
+		if bits < best.bits {
+			best = subframePlan{
+				kind:      subframeFixed,
+				order:     order,
+				partOrder: partOrder,
+				params:    params,
+				bits:      bits,
+			}
+		}
+	}
+
+	return best
+}
+
+// fixedResidual fills residual[order:] with what the fixed predictor of that
+// order gets wrong
+func fixedResidual(x []int64, order int, residual []int64) {
+	for i := order; i < len(x); i++ {
+		switch order {
+		case 0:
+			residual[i] = x[i]
+		case 1:
+			residual[i] = x[i] - x[i-1]
+		case 2:
+			residual[i] = x[i] - 2*x[i-1] + x[i-2]
+		case 3:
+			residual[i] = x[i] - 3*x[i-1] + 3*x[i-2] - x[i-3]
+		case 4:
+			residual[i] = x[i] - 4*x[i-1] + 6*x[i-2] - 4*x[i-3] + x[i-4]
+		}
+	}
+}
+
+func zigzag(r int64) uint64 {
+	return uint64(r<<1) ^ uint64(r>>63)
+}
+
+// planRice picks the partition order and rice parameters that code
+// residual[order:] in the fewest bits, going by the sum of each partition
+func planRice(residual []int64, order int) (int, []uint, uint64) {
+	n := len(residual)
+
+	// prefix sums make any partition's sum a subtraction
+	sums := make([]uint64, n+1)
+	for i := range residual {
+		var u uint64
+		if i >= order {
+			u = zigzag(residual[i])
+		}
+		sums[i+1] = sums[i] + u
+	}
+
+	bestBits := ^uint64(0)
+	var bestOrder int
+	var bestParams []uint
+
+	for p := 0; p <= maxPartitionOrder; p++ {
+		size := n >> uint(p)
+		if n%(1<<uint(p)) != 0 || size <= order {
+			break
+		}
+
+		params := make([]uint, 1<<uint(p))
+		bits := uint64(2 + 4)
+		paramBits := uint64(4)
+
+		for i := range params {
+			start, end := i*size, (i+1)*size
+			count := uint64(size)
+			if i == 0 {
+				count -= uint64(order)
+			}
+
+			k, cost := riceParam(sums[end]-sums[start], count)
+			params[i] = k
+			bits += cost
+			if k > 14 {
+				paramBits = 5
+			}
+		}
+
+		bits += paramBits * uint64(len(params))
+		if bits < bestBits {
+			bestBits, bestOrder, bestParams = bits, p, params
+		}
+	}
+
+	return bestOrder, bestParams, bestBits
+}
+
+// riceParam estimates the best rice parameter for count values adding up to
+// sum, and what they'd cost
+func riceParam(sum, count uint64) (uint, uint64) {
+	best := ^uint64(0)
+	var bestK uint
+
+	for k := uint(0); k <= 30; k++ {
+		cost := count*uint64(k+1) + sum>>k
+		if cost < best {
+			best, bestK = cost, k
+		}
+	}
+
+	return bestK, best
+}
+
+func (plan subframePlan) write(w *bitWriter, samples []int64, bps uint) {
+	mask := uint64(1)<<bps - 1
+
+	switch plan.kind {
+	case subframeConstant:
+		w.write(0, 8)
+		w.write(uint64(samples[0])&mask, bps)
+	case subframeVerbatim:
+		w.write(0x1<<1, 8)
+		for _, x := range samples {
+			w.write(uint64(x)&mask, bps)
+		}
+	case subframeFixed:
+		w.write(uint64(0x8|plan.order)<<1, 8)
+		for _, x := range samples[:plan.order] {
+			w.write(uint64(x)&mask, bps)
+		}
+
+		residual := make([]int64, len(samples))
+		fixedResidual(samples, plan.order, residual)
+
+		method, paramBits := uint64(0), uint(4)
+		for _, k := range plan.params {
+			if k > 14 {
+				method, paramBits = 1, 5
+			}
+		}
+
+		w.write(method, 2)
+		w.write(uint64(plan.partOrder), 4)
+
+		size := len(samples) >> uint(plan.partOrder)
+		for i, k := range plan.params {
+			w.write(uint64(k), paramBits)
+
+			start := i * size
+			if i == 0 {
+				start = plan.order
+			}
+
+			for _, r := range residual[start : (i+1)*size] {
+				u := zigzag(r)
+				w.unary(u >> k)
+				w.write(u, k)
+			}
+		}
+	}
+}
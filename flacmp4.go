@@ -0,0 +1,362 @@
+package tidl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrNoFlacTrack is returned when an mp4 file has no fLaC track
+var ErrNoFlacTrack = errors.New("mp4 has no flac track")
+
+// flacTrack is what the demuxer needs to know about the fLaC track
+type flacTrack struct {
+	id          uint32
+	dfLa        []byte
+	sizes       []uint32
+	chunks      []uint64
+	stsc        []stscEntry
+	defaultSize uint32
+}
+
+type stscEntry struct {
+	firstChunk      uint32
+	samplesPerChunk uint32
+}
+
+// demuxFlacMP4 rebuilds the native FLAC stream of the first fLaC track in an
+// mp4 file. STREAMINFO and the other metadata blocks come from the dfLa box,
+// the frames are copied out of mdat for both plain and fragmented files.
+func demuxFlacMP4(data []byte) ([]byte, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil, ErrNotMP4
+	}
+
+	tr, err := findFlacTrack(moov.body(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// dfLa is a full box holding the metadata blocks as they appear in a
+	// native stream, last-metadata-block flag included
+	if len(tr.dfLa) < 4+4+34 {
+		return nil, errors.New("mp4: dfLa box too short")
+	}
+
+	out := append([]byte("fLaC"), tr.dfLa[4:]...)
+
+	frames, err := tr.samples(data, top)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+
+	return out, nil
+}
+
+// remuxFlac replaces the mp4 at path with the flac stream inside it, it
+// reports false if the file has no fLaC track
+func remuxFlac(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	flacData, err := demuxFlacMP4(data)
+	if err == ErrNoFlacTrack || err == ErrNotMP4 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, ioutil.WriteFile(path, flacData, 0777)
+}
+
+func findFlacTrack(moov []byte) (flacTrack, error) {
+	children, err := readBoxes(moov)
+	if err != nil {
+		return flacTrack{}, err
+	}
+
+	var defaultSizes = make(map[uint32]uint32)
+	if mvex, ok := findBox(children, "mvex"); ok {
+		boxes, err := readBoxes(mvex.body(moov))
+		if err != nil {
+			return flacTrack{}, err
+		}
+
+		for _, box := range boxes {
+			if b := box.body(mvex.body(moov)); box.typ == "trex" && len(b) >= 24 {
+				defaultSizes[binary.BigEndian.Uint32(b[4:])] = binary.BigEndian.Uint32(b[16:])
+			}
+		}
+	}
+
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+
+		var tr flacTrack
+		err := walkBoxes(trak.body(moov), func(path string, box mp4Box) {
+			body := box.body(trak.body(moov))
+
+			switch path {
+			case "tkhd":
+				if len(body) >= 24 && body[0] == 1 {
+					tr.id = binary.BigEndian.Uint32(body[20:])
+				} else if len(body) >= 16 {
+					tr.id = binary.BigEndian.Uint32(body[12:])
+				}
+			case "mdia/minf/stbl/stsd":
+				tr.dfLa = findDfLa(body)
+			case "mdia/minf/stbl/stsz":
+				if len(body) < 12 {
+					return
+				}
+				size := binary.BigEndian.Uint32(body[4:])
+				n := int(binary.BigEndian.Uint32(body[8:]))
+				for i := 0; i < n; i++ {
+					if size != 0 {
+						tr.sizes = append(tr.sizes, size)
+					} else if 12+i*4+4 <= len(body) {
+						tr.sizes = append(tr.sizes, binary.BigEndian.Uint32(body[12+i*4:]))
+					}
+				}
+			case "mdia/minf/stbl/stco":
+				for i := 0; len(body) >= 8 && i < int(binary.BigEndian.Uint32(body[4:])) && 8+i*4+4 <= len(body); i++ {
+					tr.chunks = append(tr.chunks, uint64(binary.BigEndian.Uint32(body[8+i*4:])))
+				}
+			case "mdia/minf/stbl/co64":
+				for i := 0; len(body) >= 8 && i < int(binary.BigEndian.Uint32(body[4:])) && 8+i*8+8 <= len(body); i++ {
+					tr.chunks = append(tr.chunks, binary.BigEndian.Uint64(body[8+i*8:]))
+				}
+			case "mdia/minf/stbl/stsc":
+				for i := 0; len(body) >= 8 && i < int(binary.BigEndian.Uint32(body[4:])) && 8+i*12+12 <= len(body); i++ {
+					p := body[8+i*12:]
+					tr.stsc = append(tr.stsc, stscEntry{
+						firstChunk:      binary.BigEndian.Uint32(p),
+						samplesPerChunk: binary.BigEndian.Uint32(p[4:]),
+					})
+				}
+			}
+		})
+		if err != nil {
+			return flacTrack{}, err
+		}
+
+		if tr.dfLa != nil {
+			tr.defaultSize = defaultSizes[tr.id]
+			return tr, nil
+		}
+	}
+
+	return flacTrack{}, ErrNoFlacTrack
+}
+
+// findDfLa returns the body of the dfLa box of a fLaC sample entry
+func findDfLa(stsd []byte) []byte {
+	if len(stsd) < 8 {
+		return nil
+	}
+
+	entries, err := readBoxes(stsd[8:])
+	if err != nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		// 8 bytes of sample entry and 20 of audio sample entry before the
+		// child boxes
+		body := entry.body(stsd[8:])
+		if entry.typ != "fLaC" || len(body) < 28 {
+			continue
+		}
+
+		boxes, err := readBoxes(body[28:])
+		if err != nil {
+			return nil
+		}
+
+		if dfLa, ok := findBox(boxes, "dfLa"); ok {
+			return dfLa.body(body[28:])
+		}
+	}
+
+	return nil
+}
+
+// samples returns the flac frames of the track in decoding order
+func (tr flacTrack) samples(data []byte, top []mp4Box) ([][]byte, error) {
+	var frames [][]byte
+
+	slice := func(off, size uint64) error {
+		if off+size > uint64(len(data)) {
+			return fmt.Errorf("mp4: sample at %v runs past the end of the file", off)
+		}
+		frames = append(frames, data[off:off+size])
+		return nil
+	}
+
+	// plain files list every sample in the sample table
+	sample := 0
+	for i, chunk := range tr.chunks {
+		off := chunk
+		for n := tr.samplesPerChunk(uint32(i + 1)); n > 0 && sample < len(tr.sizes); n-- {
+			if err := slice(off, uint64(tr.sizes[sample])); err != nil {
+				return nil, err
+			}
+			off += uint64(tr.sizes[sample])
+			sample++
+		}
+	}
+
+	// fragmented files describe the samples in each moof
+	for _, moof := range top {
+		if moof.typ != "moof" {
+			continue
+		}
+
+		boxes, err := readBoxes(moof.body(data))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, traf := range boxes {
+			if traf.typ != "traf" {
+				continue
+			}
+
+			if err := tr.fragment(data, moof, traf, slice); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(frames) == 0 {
+		return nil, errors.New("mp4: flac track has no samples")
+	}
+
+	return frames, nil
+}
+
+func (tr flacTrack) samplesPerChunk(chunk uint32) uint32 {
+	var n uint32
+	for _, entry := range tr.stsc {
+		if entry.firstChunk > chunk {
+			break
+		}
+		n = entry.samplesPerChunk
+	}
+
+	return n
+}
+
+// fragment slices the samples of a single traf
+func (tr flacTrack) fragment(data []byte, moof, traf mp4Box, slice func(off, size uint64) error) error {
+	body := data[moof.start+moof.hdr : moof.end]
+	body = body[traf.start+traf.hdr : traf.end]
+
+	boxes, err := readBoxes(body)
+	if err != nil {
+		return err
+	}
+
+	base := uint64(moof.start)
+	defaultSize := tr.defaultSize
+
+	// a run without a data offset starts where the previous one ended
+	next := base
+
+	for _, box := range boxes {
+		b := box.body(body)
+
+		switch box.typ {
+		case "tfhd":
+			if len(b) < 8 {
+				return errors.New("mp4: tfhd box too short")
+			}
+
+			flags := binary.BigEndian.Uint32(b) & 0xffffff
+			if binary.BigEndian.Uint32(b[4:]) != tr.id {
+				return nil
+			}
+
+			p := b[8:]
+			if flags&0x1 != 0 && len(p) >= 8 {
+				base = binary.BigEndian.Uint64(p)
+				p = p[8:]
+			}
+			for _, bit := range []uint32{0x2, 0x8} {
+				if flags&bit != 0 && len(p) >= 4 {
+					p = p[4:]
+				}
+			}
+			if flags&0x10 != 0 && len(p) >= 4 {
+				defaultSize = binary.BigEndian.Uint32(p)
+			}
+			next = base
+		case "trun":
+			if len(b) < 8 {
+				return errors.New("mp4: trun box too short")
+			}
+
+			flags := binary.BigEndian.Uint32(b) & 0xffffff
+			n := int(binary.BigEndian.Uint32(b[4:]))
+			p := b[8:]
+
+			off := next
+			if flags&0x1 != 0 && len(p) >= 4 {
+				off = uint64(int64(base) + int64(int32(binary.BigEndian.Uint32(p))))
+				p = p[4:]
+			}
+			if flags&0x4 != 0 && len(p) >= 4 {
+				p = p[4:]
+			}
+
+			// each sample has a field for every optional bit that is set,
+			// duration, size, flags and composition offset in that order
+			fields := 0
+			for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if flags&bit != 0 {
+					fields++
+				}
+			}
+
+			if len(p) < n*fields*4 {
+				return errors.New("mp4: trun box too short")
+			}
+
+			for i := 0; i < n; i++ {
+				size := defaultSize
+				for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+					if flags&bit == 0 {
+						continue
+					}
+					if bit == 0x200 {
+						size = binary.BigEndian.Uint32(p)
+					}
+					p = p[4:]
+				}
+
+				if err := slice(off, uint64(size)); err != nil {
+					return err
+				}
+				off += uint64(size)
+			}
+			next = off
+		}
+	}
+
+	return nil
+}
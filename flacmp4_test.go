@@ -0,0 +1,203 @@
+package tidl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFlacFrames encodes a short stereo stream and returns it whole, along
+// with its metadata blocks and frames
+func testFlacFrames(t *testing.T) (whole, head []byte, frames [][]byte) {
+	dir, err := ioutil.TempDir("", "tidl-flacmp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rng := rand.New(rand.NewSource(4))
+	n := flacBlockSize*4 + 100
+	samples := [][]int64{noiseSignal(rng, n, 16), sineSignal(n, 16, 440)}
+
+	path := filepath.Join(dir, "test.flac")
+	writeTestFlac(t, path, 44100, 16, testTrack{samples: samples, tags: testTags(1, "Song")})
+
+	whole = mustReadFile(t, path)
+	size, err := flacMetadataSize(bytes.NewReader(whole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := newFrameEncoder(44100, len(samples), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for num, start := uint64(0), 0; start < n; num, start = num+1, start+flacBlockSize {
+		end := start + flacBlockSize
+		if end > n {
+			end = n
+		}
+
+		frames = append(frames, enc.encode(num, [][]int64{samples[0][start:end], samples[1][start:end]}))
+	}
+
+	if !bytes.Equal(bytes.Join(frames, nil), whole[size:]) {
+		t.Fatal("frames don't add up to the stream")
+	}
+
+	return whole, whole[:size], frames
+}
+
+// flacTrak is a trak with a fLaC sample entry, stbl holds the sample table
+// boxes of plain files
+func flacTrak(id uint32, head []byte, stbl ...[]byte) []byte {
+	// sample entry and audio sample entry fields come before dfLa
+	entry := makeBox("fLaC", make([]byte, 28), fullBox("dfLa", head[4:]))
+	stsd := fullBox("stsd", u32(1), entry)
+
+	return makeBox("trak",
+		fullBox("tkhd", u32(0), u32(0), u32(id), make([]byte, 68)),
+		makeBox("mdia", makeBox("minf", makeBox("stbl", append([][]byte{stsd}, stbl...)...))))
+}
+
+// plainFlacMP4 puts frames in chunks of two, then one, after a track that
+// isn't flac. mdat comes first so the chunk offsets are known up front.
+func plainFlacMP4(head []byte, frames [][]byte) []byte {
+	ftyp := makeBox("ftyp", []byte("M4A "), u32(0), []byte("M4A isom"))
+	mdat := makeBox("mdat", bytes.Join(frames, nil))
+
+	var sizes [][]byte
+	for _, frame := range frames {
+		sizes = append(sizes, u32(uint32(len(frame))))
+	}
+	stsz := fullBox("stsz", u32(0), u32(uint32(len(frames))), bytes.Join(sizes, nil))
+
+	// chunks 1 and 2 hold two frames, every chunk after that one
+	stsc := fullBox("stsc", u32(2), u32(1), u32(2), u32(1), u32(3), u32(1), u32(1))
+
+	var offsets []int64
+	off := len(ftyp) + 8
+	for i, frame := range frames {
+		if i >= 4 || i%2 == 0 {
+			offsets = append(offsets, int64(off))
+		}
+		off += len(frame)
+	}
+
+	moov := makeBox("moov",
+		fullBox("mvhd", make([]byte, 96)),
+		audioTrak(chunkTable("stco", nil)),
+		flacTrak(2, head, stsz, stsc, chunkTable("co64", offsets)))
+
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+// fragmentedFlacMP4 spreads frames over two fragments. The first has a traf
+// of another track and two runs, only the first of which has a data offset.
+// The second has an explicit base offset in tfhd instead.
+func fragmentedFlacMP4(head []byte, frames [][]byte) []byte {
+	ftyp := makeBox("ftyp", []byte("iso6"), u32(0), []byte("iso6dash"))
+	moov := makeBox("moov",
+		fullBox("mvhd", make([]byte, 96)),
+		flacTrak(2, head),
+		makeBox("mvex", fullBox("trex", u32(2), u32(1), u32(0), u32(0), u32(0))))
+
+	run := func(flags uint32, offset int32, frames [][]byte) []byte {
+		payload := [][]byte{u32(flags | 0x200), u32(uint32(len(frames)))}
+		if flags&0x1 != 0 {
+			payload = append(payload, u32(uint32(offset)))
+		}
+		for _, frame := range frames {
+			payload = append(payload, u32(uint32(len(frame))))
+		}
+		return makeBox("trun", payload...)
+	}
+
+	// moof sizes don't depend on the offsets in them, so they're built once
+	// to measure
+	moof1 := func(offset int32) []byte {
+		return makeBox("moof",
+			fullBox("mfhd", u32(1)),
+			makeBox("traf", fullBox("tfhd", u32(9)), run(0x1, 0, frames[:1])),
+			makeBox("traf",
+				fullBox("tfhd", u32(2)),
+				run(0x1, offset, frames[:2]),
+				run(0, 0, frames[2:4])))
+	}
+	first := moof1(int32(len(moof1(0)) + 8))
+	mdat1 := makeBox("mdat", bytes.Join(frames[:4], nil))
+
+	moof2 := func(base uint64) []byte {
+		return makeBox("moof",
+			fullBox("mfhd", u32(2)),
+			makeBox("traf", makeBox("tfhd", u32(0x1), u32(2), u64(base)), run(0, 0, frames[4:])))
+	}
+	start := len(ftyp) + len(moov) + len(first) + len(mdat1)
+	second := moof2(uint64(start + len(moof2(0)) + 8))
+	mdat2 := makeBox("mdat", bytes.Join(frames[4:], nil))
+
+	return bytes.Join([][]byte{ftyp, moov, first, mdat1, second, mdat2}, nil)
+}
+
+func TestDemuxFlacMP4(t *testing.T) {
+	whole, head, frames := testFlacFrames(t)
+
+	files := map[string][]byte{
+		"plain":      plainFlacMP4(head, frames),
+		"fragmented": fragmentedFlacMP4(head, frames),
+	}
+
+	for name, data := range files {
+		got, err := demuxFlacMP4(data)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if !bytes.Equal(got, whole) {
+			t.Errorf("%v: demuxed stream differs", name)
+		}
+	}
+}
+
+func TestDemuxFlacMP4NoFlac(t *testing.T) {
+	if _, err := demuxFlacMP4(plainMP4("stco", nil)); err != ErrNoFlacTrack {
+		t.Errorf("got %v, want ErrNoFlacTrack", err)
+	}
+}
+
+func TestRemuxFlac(t *testing.T) {
+	whole, head, frames := testFlacFrames(t)
+
+	dir, err := ioutil.TempDir("", "tidl-flacmp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "track")
+	if err := ioutil.WriteFile(path, plainFlacMP4(head, frames), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := remuxFlac(path); !ok || err != nil {
+		t.Fatalf("remuxed %v: %v", ok, err)
+	}
+	if !bytes.Equal(mustReadFile(t, path), whole) {
+		t.Error("remuxed file differs")
+	}
+
+	// mp4 without a flac track, left alone
+	plain := plainMP4("stco", nil)
+	if err := ioutil.WriteFile(path, plain, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := remuxFlac(path); ok || err != nil {
+		t.Errorf("remuxed aac %v: %v", ok, err)
+	}
+	if !bytes.Equal(mustReadFile(t, path), plain) {
+		t.Error("aac file changed")
+	}
+}
@@ -7,5 +7,6 @@ require (
 	github.com/h2non/filetype v1.1.0
 	github.com/icza/bitio v0.0.0-20180221120200-b25b30b42508
 	github.com/mewkiz/flac v1.0.5-0.20180818192143-4309906bb81e
+	golang.org/x/text v0.3.3
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 )
@@ -0,0 +1,487 @@
+package tidl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// ErrImageMismatch is returned when an album image doesn't decode to the
+// audio it was made from
+var ErrImageMismatch = errors.New("image audio doesn't match")
+
+// tags that describe a single track and don't belong on an album image
+var trackOnlyTags = []string{
+	"TITLE", "TRACKNUMBER", "TRACKTOTAL", "DISCNUMBER", "DISCTOTAL", "ISRC",
+	"LYRICS", "TIDAL_TRACK_ID", "REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK",
+}
+
+// JoinFlac decodes the FLAC files at paths and encodes them back to back
+// into one gapless image at out, with a CUESHEET block marking where each
+// track starts and a .cue file next to it. The tracks need the same sample
+// rate, channels and sample size.
+func JoinFlac(out string, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no tracks to join")
+	}
+
+	// cue sheets only count to 99
+	if len(paths) > 99 {
+		return fmt.Errorf("%v tracks is too many for a cue sheet", len(paths))
+	}
+
+	var heads []*flac.Stream
+	var tags []Tags
+	for _, path := range paths {
+		head, err := readFlacHead(path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", filepath.Base(path), err)
+		}
+
+		if len(heads) > 0 {
+			a, b := heads[0].Info, head.Info
+			if a.SampleRate != b.SampleRate || a.NChannels != b.NChannels || a.BitsPerSample != b.BitsPerSample {
+				return fmt.Errorf("%v: %w, it differs from the first track", filepath.Base(path), ErrSampleFormat)
+			}
+		}
+
+		heads = append(heads, head)
+		tags = append(tags, append(Tags{}, flacComment(head).Tags...))
+	}
+
+	info := *heads[0].Info
+	enc, err := newFrameEncoder(info.SampleRate, int(info.NChannels), info.BitsPerSample)
+	if err != nil {
+		return err
+	}
+
+	// the first track's metadata is the template, minus anything that
+	// describes its audio or only that track
+	stream := heads[0]
+	stream.Info = &info
+	info.BlockSizeMin, info.BlockSizeMax = flacBlockSize, flacBlockSize
+	info.FrameSizeMin, info.FrameSizeMax = 0, 0
+	info.MD5sum = [md5.Size]uint8{}
+	info.NSamples = 0
+
+	blocks := stream.Blocks[:0]
+	for _, block := range stream.Blocks {
+		switch block.Body.(type) {
+		case *meta.VorbisComment, *meta.Picture:
+			blocks = append(blocks, block)
+		}
+	}
+	stream.Blocks = blocks
+
+	flacComment(stream).Tags = imageTags(tags)
+
+	cue := &meta.CueSheet{}
+	for i, head := range heads {
+		cue.Tracks = append(cue.Tracks, meta.CueSheetTrack{
+			Offset:   info.NSamples,
+			Num:      uint8(i + 1),
+			ISRC:     cueISRC(tags[i]),
+			IsAudio:  true,
+			Indicies: []meta.CueSheetTrackIndex{{Num: 1}},
+		})
+		info.NSamples += head.Info.NSamples
+	}
+	cue.Tracks = append(cue.Tracks, meta.CueSheetTrack{Offset: info.NSamples, Num: 255})
+
+	stream.Blocks = append(stream.Blocks, &meta.Block{
+		Header: meta.Header{Type: meta.TypeCueSheet},
+		Body:   cue,
+	})
+
+	// written once up front and again with the real numbers, the block
+	// sizes don't depend on them
+	head, err := encodeFlacMetadata(stream, FlacPadding)
+	if err != nil {
+		return err
+	}
+
+	tmp := out + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if _, err := f.Write(head); err != nil {
+		return fail(err)
+	}
+
+	sum := md5.New()
+	pending := make([][]int64, info.NChannels)
+	var num, total uint64
+
+	emit := func(n int) error {
+		chunk := make([][]int64, len(pending))
+		for ch := range pending {
+			chunk[ch] = pending[ch][:n]
+		}
+
+		data := enc.encode(num, chunk)
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+
+		size := uint32(len(data))
+		if info.FrameSizeMin == 0 || size < info.FrameSizeMin {
+			info.FrameSizeMin = size
+		}
+		if size > info.FrameSizeMax {
+			info.FrameSizeMax = size
+		}
+
+		for ch := range pending {
+			pending[ch] = append(pending[ch][:0], pending[ch][n:]...)
+		}
+		num++
+
+		return nil
+	}
+
+	for i, path := range paths {
+		cue.Tracks[i].Offset = total
+
+		err := decodeFlac(path, func(fr *frame.Frame) error {
+			n := int(fr.BlockSize)
+			for ch, subframe := range fr.Subframes {
+				for _, x := range subframe.Samples[:n] {
+					pending[ch] = append(pending[ch], int64(x))
+				}
+			}
+
+			hashSamples(sum, fr, info.BitsPerSample, 0, n)
+			total += uint64(n)
+
+			for len(pending[0]) >= flacBlockSize {
+				if err := emit(flacBlockSize); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return fail(fmt.Errorf("%v: %w", filepath.Base(path), err))
+		}
+	}
+
+	if len(pending[0]) > 0 {
+		if err := emit(len(pending[0])); err != nil {
+			return fail(err)
+		}
+	}
+
+	info.NSamples = total
+	copy(info.MD5sum[:], sum.Sum(nil))
+	cue.Tracks[len(cue.Tracks)-1].Offset = total
+
+	final, err := encodeFlacMetadata(stream, FlacPadding)
+	if err != nil {
+		return fail(err)
+	}
+
+	if len(final) != len(head) {
+		return fail(errors.New("image metadata changed size"))
+	}
+
+	if _, err := f.WriteAt(final, 0); err != nil {
+		return fail(err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	sheet := renderCue(filepath.Base(out), flacComment(stream).Tags, tags, cue, info.SampleRate)
+	if err := ioutil.WriteFile(cuePath(out), sheet, 0777); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, out)
+}
+
+// VerifyFlacImage decodes an image written by JoinFlac, checks it against
+// its STREAMINFO MD5 and splits it at the cue sheet to check every track
+// against the file it was made from
+func VerifyFlacImage(image string, paths []string) error {
+	head, err := readFlacHead(image)
+	if err != nil {
+		return err
+	}
+
+	var cue *meta.CueSheet
+	for _, block := range head.Blocks {
+		if body, ok := block.Body.(*meta.CueSheet); ok {
+			cue = body
+		}
+	}
+
+	if cue == nil || len(cue.Tracks) != len(paths)+1 {
+		return fmt.Errorf("%w: cue sheet doesn't list %v tracks", ErrImageMismatch, len(paths))
+	}
+
+	info := head.Info
+	whole := md5.New()
+	spans := make([]hash.Hash, len(paths))
+	for i := range spans {
+		spans[i] = md5.New()
+	}
+
+	var pos uint64
+	err = decodeFlac(image, func(fr *frame.Frame) error {
+		n := uint64(fr.BlockSize)
+		hashSamples(whole, fr, info.BitsPerSample, 0, int(n))
+
+		for i := range spans {
+			start, end := cue.Tracks[i].Offset, cue.Tracks[i+1].Offset
+			if end <= pos || start >= pos+n {
+				continue
+			}
+
+			from, to := uint64(0), n
+			if start > pos {
+				from = start - pos
+			}
+			if end < pos+n {
+				to = end - pos
+			}
+
+			hashSamples(spans[i], fr, info.BitsPerSample, int(from), int(to))
+		}
+
+		pos += n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(whole.Sum(nil), info.MD5sum[:]) {
+		return fmt.Errorf("%w: MD5 of %v", ErrImageMismatch, filepath.Base(image))
+	}
+
+	for i, path := range paths {
+		want := md5.New()
+		err := decodeFlac(path, func(fr *frame.Frame) error {
+			hashSamples(want, fr, info.BitsPerSample, 0, int(fr.BlockSize))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %w", filepath.Base(path), err)
+		}
+
+		if !bytes.Equal(want.Sum(nil), spans[i].Sum(nil)) {
+			return fmt.Errorf("%w: %v", ErrImageMismatch, filepath.Base(path))
+		}
+	}
+
+	return nil
+}
+
+// IsAlbumImage reports whether path is an image JoinFlac wrote, going by the
+// .cue next to it
+func IsAlbumImage(path string) bool {
+	_, err := os.Stat(cuePath(path))
+	return err == nil
+}
+
+func cuePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".cue"
+}
+
+// albumImage joins the downloaded tracks of an album into an image named
+// after it in dir. Albums that aren't all FLAC are skipped.
+func (t *Tidal) albumImage(dir string, al Album, tmpl *Template, tracks []Track) error {
+	var paths []string
+	for _, tr := range tracks {
+		path := tr.findFile(t.Root, tmpl)
+		if path == "" {
+			return fmt.Errorf("%v: can't make album image, track missing", tr.Title)
+		}
+
+		if !strings.EqualFold(filepath.Ext(path), ".flac") {
+			return nil
+		}
+
+		paths = append(paths, path)
+	}
+
+	out := filepath.Join(dir, t.Sanitizer.component(al.Title, extensionReserve)+".flac")
+	if _, err := os.Stat(out); err == nil {
+		return nil
+	}
+
+	if err := JoinFlac(out, paths); err != nil {
+		return err
+	}
+
+	if err := VerifyFlacImage(out, paths); err != nil {
+		os.Remove(out)
+		os.Remove(cuePath(out))
+		return err
+	}
+
+	if t.SeekTable > 0 {
+		_, err := WriteSeekTable(out, t.SeekTable)
+		return err
+	}
+
+	return nil
+}
+
+// decodeFlac calls fn with every decoded frame of a FLAC file
+func decodeFlac(path string, fn func(*frame.Frame) error) error {
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for {
+		fr, err := stream.ParseNext()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(fr); err != nil {
+			return err
+		}
+	}
+}
+
+// hashSamples adds samples [from, to) of a frame to h the way the STREAMINFO
+// MD5 covers them, interleaved little endian in whole bytes
+func hashSamples(h hash.Hash, fr *frame.Frame, bps uint8, from, to int) {
+	width := int(bps+7) / 8
+	buf := make([]byte, 0, (to-from)*len(fr.Subframes)*width)
+
+	for i := from; i < to; i++ {
+		for _, subframe := range fr.Subframes {
+			x := subframe.Samples[i]
+			for b := 0; b < width; b++ {
+				buf = append(buf, byte(x>>uint(8*b)))
+			}
+		}
+	}
+
+	h.Write(buf)
+}
+
+// imageTags keeps the tags every track agrees on, minus the ones that only
+// make sense per track
+func imageTags(tracks []Tags) Tags {
+	var tags Tags
+
+	for _, key := range tracks[0].Keys() {
+		if containsString(trackOnlyTags, key) {
+			continue
+		}
+
+		values := tracks[0].Get(key)
+		same := true
+		for _, other := range tracks[1:] {
+			same = same && strings.Join(other.Get(key), "\x00") == strings.Join(values, "\x00")
+		}
+
+		if same {
+			for _, value := range values {
+				tags.Add(key, value)
+			}
+		}
+	}
+
+	return tags
+}
+
+// cueISRC returns the ISRC of a track the way cue sheets want it, twelve
+// characters without dashes
+func cueISRC(tags Tags) string {
+	values := tags.Get("ISRC")
+	if len(values) == 0 {
+		return ""
+	}
+
+	isrc := strings.ToUpper(strings.Replace(values[0], "-", "", -1))
+	if len(isrc) != 12 {
+		return ""
+	}
+
+	return isrc
+}
+
+func renderCue(file string, album Tags, tracks []Tags, cue *meta.CueSheet, sampleRate uint32) []byte {
+	quote := func(s string) string {
+		s = strings.Join(strings.Fields(s), " ")
+		return `"` + strings.Replace(s, `"`, "'", -1) + `"`
+	}
+
+	first := func(tags Tags, keys ...string) string {
+		for _, key := range keys {
+			if values := tags.Get(key); len(values) > 0 {
+				return strings.Join(values, ", ")
+			}
+		}
+		return ""
+	}
+
+	var b bytes.Buffer
+	// tidal has no genres, this is for files that were tagged with one
+	if genre := first(album, "GENRE"); genre != "" {
+		fmt.Fprintf(&b, "REM GENRE %v\n", quote(genre))
+	}
+	if date := first(album, "DATE"); date != "" {
+		fmt.Fprintf(&b, "REM DATE %v\n", date)
+	}
+	if performer := first(album, "ALBUMARTIST", "ARTIST"); performer != "" {
+		fmt.Fprintf(&b, "PERFORMER %v\n", quote(performer))
+	}
+	if title := first(album, "ALBUM"); title != "" {
+		fmt.Fprintf(&b, "TITLE %v\n", quote(title))
+	}
+	fmt.Fprintf(&b, "FILE %v WAVE\n", quote(file))
+
+	for i, tags := range tracks {
+		track := cue.Tracks[i]
+
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", track.Num)
+		if title := first(tags, "TITLE"); title != "" {
+			fmt.Fprintf(&b, "    TITLE %v\n", quote(title))
+		}
+		if performer := first(tags, "ARTIST"); performer != "" {
+			fmt.Fprintf(&b, "    PERFORMER %v\n", quote(performer))
+		}
+		if track.ISRC != "" {
+			fmt.Fprintf(&b, "    ISRC %v\n", track.ISRC)
+		}
+
+		// cue sheets count in CD frames, 75 a second
+		frames := track.Offset * 75 / uint64(sampleRate)
+		fmt.Fprintf(&b, "    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75)
+	}
+
+	return b.Bytes()
+}
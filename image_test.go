@@ -0,0 +1,448 @@
+package tidl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+// testTrack is a synthesized track, one slice of samples per channel
+type testTrack struct {
+	samples [][]int64
+	tags    Tags
+}
+
+// writeTestFlac encodes a track with the frame encoder and returns the MD5 of
+// its samples the way STREAMINFO covers them
+func writeTestFlac(t *testing.T, path string, rate uint32, bps uint8, tr testTrack) []byte {
+	t.Helper()
+
+	// the smallest stream flac.Parse takes, a lone STREAMINFO block
+	w := &bitWriter{}
+	w.write(0x664c6143, 32)
+	w.write(1, 1)
+	w.write(uint64(meta.TypeStreamInfo), 7)
+	w.write(34, 24)
+	w.write(flacBlockSize, 16)
+	w.write(flacBlockSize, 16)
+	w.write(0, 48)
+	w.write(44100, 20)
+	w.write(0, 3)
+	w.write(15, 5)
+	w.write(0, 36)
+	w.write(0, 64)
+	w.write(0, 64)
+
+	stream, err := flac.Parse(bytes.NewReader(w.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(tr.samples[0])
+	sum := md5Samples(tr.samples, bps, 0, n)
+
+	stream.Info = &meta.StreamInfo{
+		BlockSizeMin:  flacBlockSize,
+		BlockSizeMax:  flacBlockSize,
+		SampleRate:    rate,
+		NChannels:     uint8(len(tr.samples)),
+		BitsPerSample: bps,
+		NSamples:      uint64(n),
+	}
+	copy(stream.Info.MD5sum[:], sum)
+	flacComment(stream).Tags = tr.tags
+
+	head, err := encodeFlacMetadata(stream, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := newFrameEncoder(rate, len(tr.samples), bps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(head)
+	for num, start := uint64(0), 0; start < n; num, start = num+1, start+flacBlockSize {
+		end := start + flacBlockSize
+		if end > n {
+			end = n
+		}
+
+		chunk := make([][]int64, len(tr.samples))
+		for ch := range chunk {
+			chunk[ch] = tr.samples[ch][start:end]
+		}
+
+		buf.Write(enc.encode(num, chunk))
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	return sum
+}
+
+// md5Samples hashes samples [from, to) interleaved little endian in whole bytes
+func md5Samples(samples [][]int64, bps uint8, from, to int) []byte {
+	width := int(bps+7) / 8
+
+	var buf []byte
+	for i := from; i < to; i++ {
+		for ch := range samples {
+			for b := 0; b < width; b++ {
+				buf = append(buf, byte(samples[ch][i]>>uint(8*b)))
+			}
+		}
+	}
+
+	sum := md5.Sum(buf)
+	return sum[:]
+}
+
+// signals to exercise the constant, fixed and verbatim subframes
+func constantSignal(n int, v int64) []int64 {
+	x := make([]int64, n)
+	for i := range x {
+		x[i] = v
+	}
+	return x
+}
+
+func noiseSignal(rng *rand.Rand, n int, bps uint8) []int64 {
+	limit := int64(1) << (bps - 1)
+
+	x := make([]int64, n)
+	for i := range x {
+		x[i] = rng.Int63n(2*limit) - limit
+	}
+	return x
+}
+
+func sineSignal(n int, bps uint8, freq float64) []int64 {
+	amp := float64(int64(1)<<(bps-1)-1) * 0.8
+
+	x := make([]int64, n)
+	for i := range x {
+		x[i] = int64(amp * math.Sin(2*math.Pi*freq*float64(i)/44100))
+	}
+	return x
+}
+
+func testTags(i int, title string) Tags {
+	var tags Tags
+	tags.Add("ALBUM", "Test Album")
+	tags.Add("ALBUMARTIST", "Test Artist")
+	tags.Add("ARTIST", fmt.Sprintf("Artist %d", i))
+	tags.Add("DATE", "2001")
+	tags.Add("GENRE", "Test")
+	tags.Add("TITLE", title)
+	tags.Add("TRACKNUMBER", fmt.Sprint(i))
+	tags.Add("ISRC", fmt.Sprintf("US-ABC-01-%05d", i))
+	return tags
+}
+
+func testAlbum(rng *rand.Rand, channels int, bps uint8) []testTrack {
+	// lengths that aren't multiples of the block size, the last one is
+	// shorter than a block
+	lengths := []int{flacBlockSize*3 + 17, 10000, 1500}
+
+	var tracks []testTrack
+	for i, n := range lengths {
+		tr := testTrack{tags: testTags(i+1, fmt.Sprintf("Track \"%d\"", i+1))}
+
+		for ch := 0; ch < channels; ch++ {
+			switch i {
+			case 0:
+				// silence, then a sine so both halves land in different frames
+				x := constantSignal(flacBlockSize*2, 0)
+				x = append(x, sineSignal(n-len(x), bps, 440*float64(ch+1))...)
+				tr.samples = append(tr.samples, x)
+			case 1:
+				tr.samples = append(tr.samples, noiseSignal(rng, n, bps))
+			default:
+				tr.samples = append(tr.samples, constantSignal(n, int64(-1-ch)))
+			}
+		}
+
+		tracks = append(tracks, tr)
+	}
+
+	return tracks
+}
+
+func TestJoinFlac(t *testing.T) {
+	formats := []struct {
+		rate     uint32
+		channels int
+		bps      uint8
+	}{
+		{44100, 2, 16},
+		{96000, 2, 24},
+		{48000, 1, 16},
+		{44100, 1, 24},
+	}
+
+	for _, format := range formats {
+		name := fmt.Sprintf("%vHz-%vch-%vbit", format.rate, format.channels, format.bps)
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tidl-image")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rng := rand.New(rand.NewSource(int64(format.rate) + int64(format.bps)))
+			tracks := testAlbum(rng, format.channels, format.bps)
+
+			var sums [][]byte
+			var files []string
+			var total int
+			for i, tr := range tracks {
+				path := filepath.Join(dir, fmt.Sprintf("%02d.flac", i+1))
+				sums = append(sums, writeTestFlac(t, path, format.rate, format.bps, tr))
+				files = append(files, path)
+				total += len(tr.samples[0])
+			}
+
+			out := filepath.Join(dir, "Test Album.flac")
+			if err := JoinFlac(out, files); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := VerifyFlacImage(out, files); err != nil {
+				t.Fatal(err)
+			}
+
+			stream, err := flac.ParseFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			info := stream.Info
+			if info.SampleRate != format.rate || int(info.NChannels) != format.channels || info.BitsPerSample != format.bps {
+				t.Fatalf("got %v Hz, %v channels, %v bit", info.SampleRate, info.NChannels, info.BitsPerSample)
+			}
+			if info.NSamples != uint64(total) {
+				t.Errorf("got %v samples, want %v", info.NSamples, total)
+			}
+
+			var cue *meta.CueSheet
+			for _, block := range stream.Blocks {
+				if body, ok := block.Body.(*meta.CueSheet); ok {
+					cue = body
+				}
+			}
+			if cue == nil || len(cue.Tracks) != len(tracks)+1 {
+				t.Fatalf("bad cue sheet: %+v", cue)
+			}
+
+			decoded := make([][]int64, format.channels)
+			for {
+				fr, err := stream.ParseNext()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				for ch, subframe := range fr.Subframes {
+					for _, x := range subframe.Samples[:fr.BlockSize] {
+						decoded[ch] = append(decoded[ch], int64(x))
+					}
+				}
+			}
+
+			if len(decoded[0]) != total {
+				t.Fatalf("decoded %v samples, want %v", len(decoded[0]), total)
+			}
+
+			if got := md5Samples(decoded, format.bps, 0, total); !bytes.Equal(got, info.MD5sum[:]) {
+				t.Errorf("STREAMINFO MD5 %x doesn't match the decoded audio %x", info.MD5sum, got)
+			}
+
+			var offset uint64
+			for i, tr := range tracks {
+				start, end := cue.Tracks[i].Offset, cue.Tracks[i+1].Offset
+				if start != offset || int(end-start) != len(tr.samples[0]) {
+					t.Errorf("track %v spans %v-%v, want %v-%v", i+1, start, end, offset, offset+uint64(len(tr.samples[0])))
+				}
+
+				if got := md5Samples(decoded, format.bps, int(start), int(end)); !bytes.Equal(got, sums[i]) {
+					t.Errorf("track %v: cue span MD5 %x, want %x", i+1, got, sums[i])
+				}
+
+				if want := cueISRC(tr.tags); cue.Tracks[i].ISRC != want {
+					t.Errorf("track %v: ISRC %q, want %q", i+1, cue.Tracks[i].ISRC, want)
+				}
+
+				offset = end
+			}
+
+			tags := Tags(flacComment(stream).Tags)
+			if got := tags.Get("ALBUM"); len(got) != 1 || got[0] != "Test Album" {
+				t.Errorf("ALBUM = %q", got)
+			}
+			for _, key := range []string{"TITLE", "ARTIST", "TRACKNUMBER", "ISRC"} {
+				if tags.Has(key) {
+					t.Errorf("image kept per track tag %v", key)
+				}
+			}
+
+			if !IsAlbumImage(out) {
+				t.Error("no .cue next to the image")
+			}
+		})
+	}
+}
+
+func TestJoinFlacMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidl-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := filepath.Join(dir, "a.flac"), filepath.Join(dir, "b.flac")
+	tr := testTrack{samples: [][]int64{sineSignal(5000, 16, 440)}, tags: testTags(1, "a")}
+	writeTestFlac(t, a, 44100, 16, tr)
+	writeTestFlac(t, b, 48000, 16, tr)
+
+	if err := JoinFlac(filepath.Join(dir, "out.flac"), []string{a, b}); !errors.Is(err, ErrSampleFormat) {
+		t.Errorf("joined different sample rates: %v", err)
+	}
+
+	// the image of a, b checked against b, a
+	other := testTrack{samples: [][]int64{noiseSignal(rand.New(rand.NewSource(1)), 5000, 16)}, tags: testTags(2, "b")}
+	writeTestFlac(t, b, 44100, 16, other)
+
+	out := filepath.Join(dir, "out.flac")
+	if err := JoinFlac(out, []string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyFlacImage(out, []string{b, a}); !errors.Is(err, ErrImageMismatch) {
+		t.Errorf("verified tracks in the wrong order: %v", err)
+	}
+}
+
+// cueTrack is what parseCue reads back for a track
+type cueTrack struct {
+	num                      int
+	title, performer, isrc   string
+	minutes, seconds, frames int
+}
+
+// parseCue reads back the subset of cue sheets renderCue writes
+func parseCue(t *testing.T, sheet []byte) (map[string]string, []cueTrack) {
+	album := map[string]string{}
+	var tracks []cueTrack
+
+	unquote := func(s string) string {
+		return strings.TrimSuffix(strings.TrimPrefix(s, `"`), `"`)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(sheet))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) != 2 {
+			t.Fatalf("bad cue line %q", line)
+		}
+
+		key, value := fields[0], fields[1]
+		if !strings.HasPrefix(line, " ") {
+			if key == "REM" {
+				rem := strings.SplitN(value, " ", 2)
+				key, value = "REM "+rem[0], rem[1]
+			}
+			if key == "FILE" {
+				value = strings.TrimSuffix(value, " WAVE")
+			}
+			album[key] = unquote(value)
+			continue
+		}
+
+		switch key {
+		case "TRACK":
+			var tr cueTrack
+			if _, err := fmt.Sscanf(value, "%d AUDIO", &tr.num); err != nil {
+				t.Fatalf("bad cue line %q: %v", line, err)
+			}
+			tracks = append(tracks, tr)
+		case "TITLE":
+			tracks[len(tracks)-1].title = unquote(value)
+		case "PERFORMER":
+			tracks[len(tracks)-1].performer = unquote(value)
+		case "ISRC":
+			tracks[len(tracks)-1].isrc = value
+		case "INDEX":
+			tr := &tracks[len(tracks)-1]
+			if _, err := fmt.Sscanf(value, "01 %d:%d:%d", &tr.minutes, &tr.seconds, &tr.frames); err != nil {
+				t.Fatalf("bad cue line %q: %v", line, err)
+			}
+		default:
+			t.Fatalf("unexpected cue line %q", line)
+		}
+	}
+
+	return album, tracks
+}
+
+func TestRenderCue(t *testing.T) {
+	const rate = 44100
+
+	var album Tags
+	album.Add("ALBUM", "An   Album")
+	album.Add("ALBUMARTIST", "Some \"Band\"")
+	album.Add("GENRE", "Rock")
+	album.Add("DATE", "1999")
+
+	tracks := []Tags{testTags(1, "One"), testTags(2, "Two"), {{"TITLE", "Three"}}}
+
+	// 0, 1m02s+10 frames, 61m00s+74 frames
+	offsets := []uint64{0, (62*75 + 10) * rate / 75, (3660*75 + 74) * rate / 75}
+
+	cue := &meta.CueSheet{}
+	for i, offset := range offsets {
+		cue.Tracks = append(cue.Tracks, meta.CueSheetTrack{Offset: offset, Num: uint8(i + 1), ISRC: cueISRC(tracks[i])})
+	}
+	cue.Tracks = append(cue.Tracks, meta.CueSheetTrack{Offset: offsets[2] + rate, Num: 255})
+
+	gotAlbum, got := parseCue(t, renderCue("An Album.flac", album, tracks, cue, rate))
+
+	wantAlbum := map[string]string{
+		"REM GENRE": "Rock",
+		"REM DATE":  "1999",
+		"PERFORMER": "Some 'Band'",
+		"TITLE":     "An Album",
+		"FILE":      "An Album.flac",
+	}
+	if fmt.Sprint(gotAlbum) != fmt.Sprint(wantAlbum) {
+		t.Errorf("got album %v, want %v", gotAlbum, wantAlbum)
+	}
+
+	want := []cueTrack{
+		{1, "One", "Artist 1", "USABC0100001", 0, 0, 0},
+		{2, "Two", "Artist 2", "USABC0100002", 1, 2, 10},
+		{3, "Three", "", "", 61, 0, 74},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got tracks %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package tidl
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinked reports whether the file at path has other names a rename would
+// split it from
+func hardLinked(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
@@ -0,0 +1,24 @@
+package tidl
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinked reports whether the file at path has other names a rename would
+// split it from. The link count isn't in os.FileInfo on windows, so it comes
+// from the open handle.
+func hardLinked(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &d); err != nil {
+		return false
+	}
+
+	return d.NumberOfLinks > 1
+}
@@ -0,0 +1,427 @@
+package tidl
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewkiz/flac"
+)
+
+// ReplayGain 2.0 tags are relative to this loudness
+const replayGainReference = -18.0
+
+// Loudness is the result of an EBU R128 / ITU-R BS.1770 analysis
+type Loudness struct {
+	// Integrated loudness in LUFS, -Inf for silence
+	Integrated float64
+	// TruePeak is the highest oversampled peak, 1 is full scale
+	TruePeak float64
+
+	// mean square energy of every 400ms gating block, album loudness gates
+	// the blocks of all its tracks together
+	blocks []float64
+}
+
+// Gain is the ReplayGain 2.0 gain in dB
+func (l Loudness) Gain() float64 {
+	if math.IsInf(l.Integrated, -1) {
+		return 0
+	}
+
+	return replayGainReference - l.Integrated
+}
+
+// AnalyzeLoudness decodes a FLAC file and measures its loudness
+func AnalyzeLoudness(path string) (Loudness, error) {
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		return Loudness{}, err
+	}
+	defer stream.Close()
+
+	info := stream.Info
+	m := newLoudnessMeter(int(info.SampleRate), int(info.NChannels))
+	scale := 1 / float64(int64(1)<<(info.BitsPerSample-1))
+
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Loudness{}, err
+		}
+
+		for i := 0; i < int(frame.BlockSize); i++ {
+			for ch, subframe := range frame.Subframes {
+				m.sample[ch] = float64(subframe.Samples[i]) * scale
+			}
+			m.add()
+		}
+	}
+
+	return m.result(), nil
+}
+
+// AlbumLoudness gates the blocks of all tracks together, as if they were one
+// long track
+func AlbumLoudness(tracks []Loudness) Loudness {
+	var album Loudness
+	for _, l := range tracks {
+		album.blocks = append(album.blocks, l.blocks...)
+		album.TruePeak = math.Max(album.TruePeak, l.TruePeak)
+	}
+
+	album.Integrated = gatedLoudness(album.blocks)
+	return album
+}
+
+// biquad is a second order IIR filter in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the BS.1770 pre-filter and RLB high pass for any sample
+// rate, derived from the analog prototypes like libebur128 does
+func kWeighting(rate float64) (biquad, biquad) {
+	f0 := 1681.974450955533
+	gain := 3.999843853973347
+	q := 0.7071752369554196
+
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	return shelf, highPass
+}
+
+// channel weights for mono, stereo and 5.1 (L R C LFE Ls Rs)
+func channelWeights(n int) []float64 {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	if n == 6 {
+		weights[3] = 0
+		weights[4] = 1.41
+		weights[5] = 1.41
+	}
+
+	return weights
+}
+
+type loudnessMeter struct {
+	sample  []float64
+	weights []float64
+	shelf   []biquad
+	hp      []biquad
+	peak    []*truePeak
+
+	// 100ms segments, four of them make a gating block
+	segmentLength int
+	segmentN      int
+	segmentSum    float64
+	segments      []float64
+}
+
+func newLoudnessMeter(rate, channels int) *loudnessMeter {
+	m := &loudnessMeter{
+		sample:        make([]float64, channels),
+		weights:       channelWeights(channels),
+		segmentLength: rate / 10,
+	}
+
+	for ch := 0; ch < channels; ch++ {
+		shelf, hp := kWeighting(float64(rate))
+		m.shelf = append(m.shelf, shelf)
+		m.hp = append(m.hp, hp)
+		m.peak = append(m.peak, newTruePeak(rate))
+	}
+
+	return m
+}
+
+// add feeds the current sample of every channel
+func (m *loudnessMeter) add() {
+	for ch, x := range m.sample {
+		m.peak[ch].add(x)
+
+		y := m.hp[ch].process(m.shelf[ch].process(x))
+		m.segmentSum += m.weights[ch] * y * y
+	}
+
+	m.segmentN++
+	if m.segmentN == m.segmentLength {
+		m.segments = append(m.segments, m.segmentSum/float64(m.segmentN))
+		m.segmentN, m.segmentSum = 0, 0
+	}
+}
+
+func (m *loudnessMeter) result() Loudness {
+	var l Loudness
+
+	// 400ms blocks overlapping by 75%
+	for i := 0; i+4 <= len(m.segments); i++ {
+		energy := (m.segments[i] + m.segments[i+1] + m.segments[i+2] + m.segments[i+3]) / 4
+		l.blocks = append(l.blocks, energy)
+	}
+
+	for _, p := range m.peak {
+		l.TruePeak = math.Max(l.TruePeak, p.max)
+	}
+
+	l.Integrated = gatedLoudness(l.blocks)
+	return l
+}
+
+func energyToLUFS(e float64) float64 {
+	return -0.691 + 10*math.Log10(e)
+}
+
+// gatedLoudness applies the absolute -70 LUFS gate and the relative gate 10
+// LU below the absolute gated loudness
+func gatedLoudness(blocks []float64) float64 {
+	mean := func(threshold float64) (float64, int) {
+		var sum float64
+		var n int
+		for _, e := range blocks {
+			if energyToLUFS(e) > threshold {
+				sum += e
+				n++
+			}
+		}
+
+		if n == 0 {
+			return 0, 0
+		}
+		return sum / float64(n), n
+	}
+
+	abs, n := mean(-70)
+	if n == 0 {
+		return math.Inf(-1)
+	}
+
+	rel, n := mean(energyToLUFS(abs) - 10)
+	if n == 0 {
+		return math.Inf(-1)
+	}
+
+	return energyToLUFS(rel)
+}
+
+// truePeak oversamples a channel with a windowed sinc interpolator, 4x below
+// 96kHz and 2x below 192kHz as BS.1770 suggests
+type truePeak struct {
+	factor  int
+	phases  [][]float64
+	history []float64
+	max     float64
+}
+
+// taps of each interpolation phase
+const truePeakTaps = 12
+
+func newTruePeak(rate int) *truePeak {
+	factor := 1
+	switch {
+	case rate < 96000:
+		factor = 4
+	case rate < 192000:
+		factor = 2
+	}
+
+	tp := &truePeak{
+		factor:  factor,
+		history: make([]float64, truePeakTaps),
+	}
+
+	n := factor * truePeakTaps
+	center := float64(n-1) / 2
+	h := make([]float64, n)
+	for i := range h {
+		x := (float64(i) - center) / float64(factor)
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		window := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i+1)/float64(n+1))
+		h[i] = sinc * window
+	}
+
+	for p := 0; p < factor; p++ {
+		var phase []float64
+		for k := 0; k < truePeakTaps; k++ {
+			phase = append(phase, h[p+k*factor])
+		}
+		tp.phases = append(tp.phases, phase)
+	}
+
+	return tp
+}
+
+func (tp *truePeak) add(x float64) {
+	tp.max = math.Max(tp.max, math.Abs(x))
+
+	copy(tp.history[1:], tp.history)
+	tp.history[0] = x
+
+	if tp.factor == 1 {
+		return
+	}
+
+	for _, phase := range tp.phases {
+		var y float64
+		for k, c := range phase {
+			y += c * tp.history[k]
+		}
+		tp.max = math.Max(tp.max, math.Abs(y))
+	}
+}
+
+// WriteReplayGain analyzes the FLAC files at paths and writes their
+// REPLAYGAIN_TRACK_* tags. With album set they're treated as one album and
+// also get REPLAYGAIN_ALBUM_* tags.
+func WriteReplayGain(paths []string, album bool) error {
+	var results []Loudness
+	for _, path := range paths {
+		l, err := AnalyzeLoudness(path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", filepath.Base(path), err)
+		}
+		results = append(results, l)
+	}
+
+	albumLoudness := AlbumLoudness(results)
+
+	for i, path := range paths {
+		l := results[i]
+		err := editFlacTags(path, func(tags *Tags) {
+			tags.Set("REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", l.Gain()))
+			tags.Set("REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", l.TruePeak))
+
+			if album {
+				tags.Set("REPLAYGAIN_ALBUM_GAIN", fmt.Sprintf("%.2f dB", albumLoudness.Gain()))
+				tags.Set("REPLAYGAIN_ALBUM_PEAK", fmt.Sprintf("%.6f", albumLoudness.TruePeak))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayGain tags the downloaded tracks of an album
+func (t *Tidal) replayGain(tmpl *Template, tracks []Track) error {
+	var paths []string
+	tagged := true
+	for _, tr := range tracks {
+		path := tr.GetPath(t.Root, tmpl) + ".flac"
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		paths = append(paths, path)
+
+		head, err := readFlacHead(path)
+		tagged = tagged && err == nil && Tags(flacComment(head).Tags).Has("REPLAYGAIN_ALBUM_GAIN")
+	}
+
+	// nothing new since the album was last analyzed
+	if len(paths) == 0 || tagged {
+		return nil
+	}
+
+	return WriteReplayGain(paths, true)
+}
+
+// WriteReplayGainTree writes ReplayGain tags for every FLAC file under root.
+// Files are grouped into albums by the folder holding their meta.json, files
+// in playlist folders only get track gain. Symlinks, and hardlinks in
+// playlist folders, are skipped since the album copy they share gets
+// analyzed with its album. done is called after each group.
+func WriteReplayGainTree(root string, done func(paths []string, err error)) error {
+	var dirs []string
+	groups := make(map[string][]string)
+	albums := make(map[string]bool)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// album images would count every track twice
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".flac") || IsAlbumImage(path) {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		albumID, p := readIndex(dir)
+		if p != nil && hardLinked(path) {
+			return nil
+		}
+
+		// disc folders belong to the album one folder up
+		if _, err := os.Stat(filepath.Join(dir, "meta.json")); err != nil && (albumID != "" || p != nil) {
+			dir = filepath.Dir(dir)
+		}
+
+		if _, ok := groups[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+
+		groups[dir] = append(groups[dir], path)
+		albums[dir] = p == nil
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		done(groups[dir], WriteReplayGain(groups[dir], albums[dir]))
+	}
+
+	return nil
+}
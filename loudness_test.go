@@ -0,0 +1,86 @@
+package tidl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReplayGainTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "tidl-replaygain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	album := filepath.Join(root, "Band", "Live")
+	list := filepath.Join(root, "Mine")
+	os.MkdirAll(album, os.ModePerm)
+	os.MkdirAll(list, os.ModePerm)
+
+	indexes := map[string]string{
+		album: `{"ID":1,"Title":"Live"}`,
+		list:  `{"ID":"p","Title":"Mine"}`,
+	}
+	for dir, index := range indexes {
+		if err := ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(index), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []string{
+		filepath.Join(album, "01 Intro.flac"),
+		filepath.Join(album, "02 Song.flac"),
+		filepath.Join(list, "01 Song.flac"),
+	}
+	for i, path := range files {
+		tr := testTrack{samples: [][]int64{sineSignal(44100, 16, 440*float64(i+1))}, tags: testTags(i, "Song")}
+		writeTestFlac(t, path, 44100, 16, tr)
+	}
+
+	// links to the album copy only get analyzed with the album
+	if err := os.Link(files[0], filepath.Join(list, "02 Intro.flac")); err != nil {
+		t.Log(err)
+	}
+	if err := os.Symlink(files[1], filepath.Join(list, "03 Song.flac")); err != nil {
+		t.Log(err)
+	}
+
+	analyzed := make(map[string]int)
+	err = WriteReplayGainTree(root, func(paths []string, err error) {
+		if err != nil {
+			t.Errorf("%v: %v", paths, err)
+		}
+
+		for _, path := range paths {
+			analyzed[path]++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(analyzed) != len(files) {
+		t.Errorf("got %v files analyzed, want %v", len(analyzed), len(files))
+	}
+
+	for i, path := range files {
+		if analyzed[path] != 1 {
+			t.Errorf("%v: analyzed %v times", path, analyzed[path])
+		}
+
+		stream, err := readFlacHead(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tags := Tags(flacComment(stream).Tags)
+		if !tags.Has("REPLAYGAIN_TRACK_GAIN") {
+			t.Errorf("%v: no track gain", path)
+		}
+		if inAlbum := i < 2; tags.Has("REPLAYGAIN_ALBUM_GAIN") != inAlbum {
+			t.Errorf("%v: got album gain %v, want %v", path, !inAlbum, inAlbum)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package tidl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Lyrics struct, Subtitles holds the time synced lyrics in LRC format
+type Lyrics struct {
+	TrackID   json.Number `json:"trackId"`
+	Provider  string      `json:"lyricsProvider"`
+	Text      string      `json:"lyrics"`
+	Subtitles string      `json:"subtitles"`
+}
+
+// ErrNoLyrics is returned when tidal has no lyrics for a track
+var ErrNoLyrics = errors.New("no lyrics")
+
+// GetLyrics func
+func (t *Tidal) GetLyrics(trackID string) (Lyrics, error) {
+	var s Lyrics
+
+	err := t.get("tracks/"+trackID+"/lyrics", &url.Values{}, &s)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Text == "" && s.Subtitles == "" {
+		return s, ErrNoLyrics
+	}
+
+	return s, nil
+}
+
+var lrcTimestamp = regexp.MustCompile(`^(\[[0-9:.]+\])+\s?`)
+
+// Unsynced returns the plain lyrics, stripping timestamps from the synced
+// ones when that's all there is
+func (l Lyrics) Unsynced() string {
+	if l.Text != "" {
+		return strings.TrimSpace(l.Text)
+	}
+
+	lines := strings.Split(l.Subtitles, "\n")
+	for i, line := range lines {
+		lines[i] = lrcTimestamp.ReplaceAllString(strings.TrimSpace(line), "")
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// LRC returns the synced lyrics as an .lrc file with an id tag header, or ""
+// when there are no synced lyrics
+func (l Lyrics) LRC(tr Track) string {
+	if strings.TrimSpace(l.Subtitles) == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[ar:%v]\n", tr.artistName())
+	fmt.Fprintf(&b, "[ti:%v]\n", tr.titleName())
+	if tr.Album.Title != "" {
+		fmt.Fprintf(&b, "[al:%v]\n", tr.Album.Title)
+	}
+	if d, err := tr.Duration.Int64(); err == nil && d > 0 {
+		fmt.Fprintf(&b, "[length:%02d:%02d]\n", d/60, d%60)
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.TrimSpace(l.Subtitles))
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// writeLRC writes the .lrc sidecar for the track at path (without extension)
+func writeLRC(path string, tr Track) error {
+	lrc := tr.lyrics.LRC(tr)
+	if lrc == "" {
+		return nil
+	}
+
+	return ioutil.WriteFile(path+".lrc", []byte(lrc), 0777)
+}
+
+// BackfillLyrics looks up the lyrics of an already downloaded FLAC or MP4
+// file by its TIDAL_TRACK_ID, ISRC, or artist and title, and embeds them. It
+// reports whether the file was changed.
+func (t *Tidal) BackfillLyrics(path string) (bool, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	tags, err := readFileTags(path)
+	if err != nil {
+		return false, err
+	}
+
+	if tags.Has("LYRICS") {
+		return false, nil
+	}
+
+	tr, err := t.findTrack(tags)
+	if err != nil {
+		return false, err
+	}
+
+	tr.lyrics, err = t.GetLyrics(tr.ID.String())
+	if err != nil {
+		return false, err
+	}
+
+	if err := writeLRC(path[:len(path)-len(ext)], tr); err != nil {
+		return false, err
+	}
+
+	if ext == ".flac" {
+		err = editFlacTags(path, func(tags *Tags) {
+			tags.Set("LYRICS", tr.lyrics.Unsynced())
+		})
+	} else {
+		err = editMP4(path, []mp4Item{mp4Text(mp4Lyrics, tr.lyrics.Unsynced())})
+	}
+
+	return err == nil, err
+}
+
+// readFileTags reads the tags of a FLAC or MP4 file, MP4 atoms under their
+// vorbis comment names
+func readFileTags(path string) (Tags, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		head, err := readFlacHead(path)
+		if err != nil {
+			return nil, err
+		}
+		return Tags(flacComment(head).Tags), nil
+	case ".m4a", ".mp4":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		items, err := readMP4Items(data)
+		if err != nil {
+			return nil, err
+		}
+		return mp4Tags(items), nil
+	}
+
+	return nil, fmt.Errorf("can't read tags of %v files", filepath.Ext(path))
+}
+
+// findTrack finds the tidal track matching a file's tags
+func (t *Tidal) findTrack(tags Tags) (Track, error) {
+	first := func(key string) string {
+		if values := tags.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	isrc, artist, title := first("ISRC"), first("ARTIST"), first("TITLE")
+
+	// written on download and by retag
+	if id := first("TIDAL_TRACK_ID"); id != "" {
+		if tr, err := t.GetTrack(id); err == nil && tr.ID != "" {
+			return tr, nil
+		}
+	}
+
+	if isrc != "" {
+		if tracks, err := t.GetTracksByISRC(isrc); err == nil && len(tracks) > 0 {
+			return tracks[0], nil
+		}
+	}
+
+	if title == "" {
+		return Track{}, errors.New("file has no title tag")
+	}
+
+	tracks, err := t.SearchTracks(artist+" "+title, 20)
+	if err != nil {
+		return Track{}, err
+	}
+
+	for _, tr := range tracks {
+		if isrc != "" && tr.ISRC == isrc {
+			return tr, nil
+		}
+
+		if NormalizeTitle(tr.Title) == NormalizeTitle(title) && strings.Contains(NormalizeTitle(artist), NormalizeTitle(tr.Artist.Name)) {
+			return tr, nil
+		}
+	}
+
+	return Track{}, fmt.Errorf("no match for %v - %v", artist, title)
+}
@@ -0,0 +1,157 @@
+package tidl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testLyrics = Lyrics{
+	TrackID:   "7",
+	Text:      "line one\nline two",
+	Subtitles: "[00:01.00] line one\n[00:02.50]line two\n",
+}
+
+func TestLyricsUnsynced(t *testing.T) {
+	tests := []struct {
+		lyrics Lyrics
+		want   string
+	}{
+		{testLyrics, "line one\nline two"},
+		{Lyrics{Subtitles: testLyrics.Subtitles}, "line one\nline two"},
+		{Lyrics{Subtitles: "[00:01.00][00:09.00] chorus"}, "chorus"},
+		{Lyrics{}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.lyrics.Unsynced(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.lyrics, got, tt.want)
+		}
+	}
+}
+
+func TestLyricsLRC(t *testing.T) {
+	tr := Track{Title: "Song", Artist: Artist{Name: "Band"}, Album: Album{Title: "Album"}, Duration: "185"}
+
+	want := "[ar:Band]\n[ti:Song]\n[al:Album]\n[length:03:05]\n\n[00:01.00] line one\n[00:02.50]line two\n"
+	if got := testLyrics.LRC(tr); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+
+	if got := (Lyrics{Text: "plain"}).LRC(tr); got != "" {
+		t.Errorf("got %q without synced lyrics", got)
+	}
+}
+
+// lyricsAPI knows track 7 only by id, ISRC lookups and searches find
+// nothing
+func lyricsAPI(t *testing.T) *Tidal {
+	return testAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/tracks/7":
+			fmt.Fprint(w, `{"id":7,"title":"Song","artist":{"name":"Band"},"duration":185}`)
+		case "/v1/tracks/7/lyrics":
+			fmt.Fprintf(w, `{"trackId":7,"lyrics":%q,"subtitles":%q}`, testLyrics.Text, testLyrics.Subtitles)
+		default:
+			fmt.Fprint(w, `{"items":[],"tracks":{"items":[]}}`)
+		}
+	}))
+}
+
+func TestBackfillLyrics(t *testing.T) {
+	td := lyricsAPI(t)
+
+	dir, err := ioutil.TempDir("", "tidl-lyrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the id is all there is to go on
+	var tags Tags
+	tags.Add("TITLE", "Something Else")
+	tags.Add("TIDAL_TRACK_ID", "7")
+
+	rng := rand.New(rand.NewSource(3))
+	flacPath := filepath.Join(dir, "01 Song.FLAC")
+	writeTestFlac(t, flacPath, 44100, 16, testTrack{samples: [][]int64{noiseSignal(rng, 2000, 16)}, tags: tags})
+
+	udta := makeBox("udta", fullBox("meta",
+		fullBox("hdlr", u32(0), []byte("mdirappl"), make([]byte, 9)),
+		makeBox("ilst", renderIlstAtom(mp4FreeformKey("TIDAL_TRACK_ID"), []mp4Item{mp4Text("", "7")}))))
+
+	mp4Path := filepath.Join(dir, "02 Song.m4a")
+	if err := ioutil.WriteFile(mp4Path, plainMP4("stco", udta), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{flacPath, mp4Path} {
+		changed, err := td.BackfillLyrics(path)
+		if err != nil || !changed {
+			t.Fatalf("%v: changed %v, %v", path, changed, err)
+		}
+
+		tags, err := readFileTags(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(tags.Get("LYRICS")); got != "[line one\nline two]" {
+			t.Errorf("%v: got LYRICS %q", path, got)
+		}
+		if got := fmt.Sprint(tags.Get("TIDAL_TRACK_ID")); got != "[7]" {
+			t.Errorf("%v: lost the track id, got %v", path, got)
+		}
+
+		lrc := path[:len(path)-len(filepath.Ext(path))] + ".lrc"
+		if data, err := ioutil.ReadFile(lrc); err != nil || data[0] != '[' {
+			t.Errorf("%v: %v", lrc, err)
+		}
+
+		// already there, nothing to do
+		if changed, err := td.BackfillLyrics(path); changed || err != nil {
+			t.Errorf("%v: changed again, %v", path, err)
+		}
+	}
+
+	if _, err := os.Stat(flacPath + ".lrc"); !os.IsNotExist(err) {
+		t.Error("wrote the .lrc next to the extension")
+	}
+	checkChunks(t, mustReadFile(t, mp4Path), len(mp4Chunks))
+}
+
+func TestBackfillLyricsUnknown(t *testing.T) {
+	td := lyricsAPI(t)
+
+	dir, err := ioutil.TempDir("", "tidl-lyrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "song.m4a")
+	if err := ioutil.WriteFile(path, plainMP4("stco", nil), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := td.BackfillLyrics(path); changed || err == nil {
+		t.Errorf("backfilled a file without tags: %v", err)
+	}
+
+	if _, err := td.BackfillLyrics(filepath.Join(dir, "song.mp3")); err == nil {
+		t.Error("backfilled an mp3")
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
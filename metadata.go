@@ -0,0 +1,291 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+// FlacPadding is the padding left after the metadata of files we write, so
+// later tag edits fit without moving the audio
+const FlacPadding = 8192
+
+// largest body a metadata block header can describe
+const maxBlockLength = 1<<24 - 1
+
+// editFlacTags applies edit to the vorbis comments of a FLAC file
+func editFlacTags(path string, edit func(*Tags)) error {
+	return editFlac(path, func(stream *flac.Stream) {
+		comment := flacComment(stream)
+		tags := Tags(comment.Tags)
+		edit(&tags)
+		comment.Tags = tags
+	})
+}
+
+// flacComment returns the vorbis comment block of a stream, adding one if
+// there is none
+func flacComment(stream *flac.Stream) *meta.VorbisComment {
+	for _, block := range stream.Blocks {
+		if comment, ok := block.Body.(*meta.VorbisComment); ok {
+			return comment
+		}
+	}
+
+	comment := &meta.VorbisComment{Vendor: "Lavf57.71.100"}
+	stream.Blocks = append(stream.Blocks, &meta.Block{
+		Header: meta.Header{Type: meta.TypeVorbisComment},
+		Body:   comment,
+	})
+
+	return comment
+}
+
+// setPictures swaps in picture blocks, replacing any of the same type
+func setPictures(stream *flac.Stream, pictures []*meta.Picture) {
+	replace := make(map[uint32]bool)
+	for _, pic := range pictures {
+		replace[pic.Type] = true
+	}
+
+	blocks := stream.Blocks[:0]
+	for _, block := range stream.Blocks {
+		if pic, ok := block.Body.(*meta.Picture); ok && replace[pic.Type] {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, pic := range pictures {
+		blocks = append(blocks, &meta.Block{
+			Header: meta.Header{Type: meta.TypePicture},
+			Body:   pic,
+		})
+	}
+
+	stream.Blocks = blocks
+}
+
+// editFlac applies edit to the metadata blocks of a FLAC file. When the new
+// blocks fit in the old metadata region, with PADDING taking up the slack,
+// they're written over it in place and synced, leaving the audio untouched.
+// Otherwise the whole file is laid out again by rewriteFlac.
+func editFlac(path string, edit func(*flac.Stream)) error {
+	// edit what a playlist symlink points at rather than replacing the link
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := flacMetadataSize(f)
+	if err != nil {
+		return rewriteFlac(path, edit)
+	}
+
+	head := make([]byte, size)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return err
+	}
+
+	// the head has nothing after the metadata, so encoding it only writes
+	// the metadata back out
+	stream, err := flac.Parse(bytes.NewReader(head))
+	if err != nil {
+		return err
+	}
+
+	edit(stream)
+	stripPadding(stream)
+
+	out, err := encodeFlacMetadata(stream, 0)
+	if err != nil {
+		return err
+	}
+
+	// whatever is left needs room for a padding block header
+	slack := size - int64(len(out))
+	if slack != 0 && (slack < 4 || slack-4 > maxBlockLength) {
+		return rewriteFlac(path, edit)
+	}
+
+	if slack != 0 {
+		if out, err = encodeFlacMetadata(stream, slack-4); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.WriteAt(out, 0); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// rewriteFlac applies edit and writes the whole file out again with fresh
+// padding
+func rewriteFlac(path string, edit func(*flac.Stream)) error {
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	edit(stream)
+	stripPadding(stream)
+	addPadding(stream, FlacPadding)
+
+	return replaceFile(path, func(w io.Writer) error {
+		return flac.Encode(w, stream)
+	})
+}
+
+// replaceFile writes a new version of path with write into path.part,
+// syncs it and renames it over path, so a crash leaves the old file or the
+// new one. A rename would split a file from its other hard links, so those
+// get path.part copied over them instead.
+func replaceFile(path string, write func(io.Writer) error) error {
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if hardLinked(path) {
+		if err := copyFile(tmp, path); err != nil {
+			return err
+		}
+		return os.Remove(tmp)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// copyFile overwrites dst with the contents of src and syncs it
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// flacMetadataSize returns the length of the signature and metadata blocks,
+// which is where the first audio frame starts
+func flacMetadataSize(r io.ReaderAt) (int64, error) {
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return 0, err
+	}
+
+	if string(hdr[:]) != "fLaC" {
+		return 0, errors.New("flac: no signature at the start of the file")
+	}
+
+	off := int64(4)
+	for {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return 0, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(hdr[:]) & 0xffffff)
+		off += 4 + length
+
+		if hdr[0]&0x80 != 0 {
+			return off, nil
+		}
+	}
+}
+
+// readFlacHead parses the metadata blocks of a FLAC file without reading
+// any audio
+func readFlacHead(path string) (*flac.Stream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := flacMetadataSize(f)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, size)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+
+	return flac.Parse(bytes.NewReader(head))
+}
+
+// encodeFlacMetadata encodes the signature and metadata blocks of a stream
+// that has no audio left to read, padding adds a PADDING block of that many
+// bytes
+func encodeFlacMetadata(stream *flac.Stream, padding int64) ([]byte, error) {
+	if padding > 0 {
+		addPadding(stream, padding)
+		defer stripPadding(stream)
+	}
+
+	var buf bytes.Buffer
+	err := flac.Encode(&buf, stream)
+	return buf.Bytes(), err
+}
+
+func stripPadding(stream *flac.Stream) {
+	blocks := stream.Blocks[:0]
+	for _, block := range stream.Blocks {
+		if block.Type != meta.TypePadding {
+			blocks = append(blocks, block)
+		}
+	}
+
+	stream.Blocks = blocks
+}
+
+// addPadding adds a padding block of n bytes at the end of the metadata
+func addPadding(stream *flac.Stream, n int64) {
+	stream.Blocks = append(stream.Blocks, &meta.Block{
+		Header: meta.Header{Type: meta.TypePadding, Length: n},
+	})
+}
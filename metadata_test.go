@@ -0,0 +1,163 @@
+package tidl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flacAudio splits a FLAC file into its tags and the bytes after the
+// metadata
+func flacAudio(t *testing.T, path string) (Tags, []byte) {
+	t.Helper()
+
+	stream, err := readFlacHead(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := flacMetadataSize(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Tags(flacComment(stream).Tags), data[size:]
+}
+
+func TestEditFlacTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidl-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rng := rand.New(rand.NewSource(1))
+	tr := testTrack{
+		samples: [][]int64{noiseSignal(rng, 5000, 16), noiseSignal(rng, 5000, 16)},
+		tags:    testTags(0, "Song"),
+	}
+
+	path := filepath.Join(dir, "01.flac")
+	writeTestFlac(t, path, 44100, 16, tr)
+	_, audio := flacAudio(t, path)
+
+	// the test file has no padding, so growing it lays the file out again
+	// and shrinking it afterwards fits in place
+	edits := []struct {
+		name    string
+		title   string
+		inPlace bool
+	}{
+		{"grow", "A Much Longer Title Than The One Before", false},
+		{"shrink", "S", true},
+	}
+
+	for _, e := range edits {
+		before, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = editFlacTags(path, func(tags *Tags) { tags.Set("TITLE", e.title) })
+		if err != nil {
+			t.Fatalf("%v: %v", e.name, err)
+		}
+
+		tags, got := flacAudio(t, path)
+		if fmt.Sprint(tags.Get("TITLE")) != fmt.Sprint([]string{e.title}) || !tags.Has("ALBUM") {
+			t.Errorf("%v: got tags %v", e.name, tags)
+		}
+		if !bytes.Equal(got, audio) {
+			t.Errorf("%v: audio changed", e.name)
+		}
+
+		if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+			t.Errorf("%v: temporary file left behind", e.name)
+		}
+
+		after, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(before, after) != e.inPlace {
+			t.Errorf("%v: edited in place %v, want %v", e.name, !e.inPlace, e.inPlace)
+		}
+	}
+}
+
+func TestEditFlacTagsLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidl-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rng := rand.New(rand.NewSource(2))
+	tr := testTrack{
+		samples: [][]int64{noiseSignal(rng, 3000, 16)},
+		tags:    testTags(0, "Song"),
+	}
+
+	path := filepath.Join(dir, "01.flac")
+	writeTestFlac(t, path, 44100, 16, tr)
+
+	// make room first so the edits below fit in place
+	if err := editFlacTags(path, func(tags *Tags) { tags.Set("TITLE", "Song Again") }); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("symlink", func(t *testing.T) {
+		link := filepath.Join(dir, "symlink.flac")
+		if err := os.Symlink(path, link); err != nil {
+			t.Skip(err)
+		}
+
+		if err := editFlacTags(link, func(tags *Tags) { tags.Set("TITLE", "Via Symlink") }); err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("link replaced: %v", err)
+		}
+		if tags, _ := flacAudio(t, path); fmt.Sprint(tags.Get("TITLE")) != "[Via Symlink]" {
+			t.Errorf("target not edited, got %v", tags.Get("TITLE"))
+		}
+	})
+
+	t.Run("hardlink", func(t *testing.T) {
+		link := filepath.Join(dir, "hardlink.flac")
+		if err := os.Link(path, link); err != nil {
+			t.Skip(err)
+		}
+
+		if err := editFlacTags(link, func(tags *Tags) { tags.Set("TITLE", "Via Hardlink") }); err != nil {
+			t.Fatal(err)
+		}
+
+		if tags, _ := flacAudio(t, path); fmt.Sprint(tags.Get("TITLE")) != "[Via Hardlink]" {
+			t.Errorf("links split, got %v", tags.Get("TITLE"))
+		}
+
+		// too big for the padding, so this goes through rewriteFlac
+		long := string(bytes.Repeat([]byte("x"), 2*FlacPadding))
+		if err := editFlacTags(link, func(tags *Tags) { tags.Set("TITLE", long) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if tags, _ := flacAudio(t, path); fmt.Sprint(tags.Get("TITLE")) != "["+long+"]" {
+			t.Error("links split by rewrite")
+		}
+		if _, err := os.Stat(link + ".part"); !os.IsNotExist(err) {
+			t.Error("temporary file left behind")
+		}
+	})
+}
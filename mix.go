@@ -0,0 +1,166 @@
+package tidl
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MixImage struct
+type MixImage struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// mix types of the radios built from a track or an artist, tidal's own mixes
+// come with types like DAILY_MIX or DISCOVERY_MIX
+const (
+	MixTrackRadio  = "TRACK_RADIO"
+	MixArtistRadio = "ARTIST_RADIO"
+)
+
+// Mix struct, mixes are generated per user and change daily
+type Mix struct {
+	ID       string              `json:"id"`
+	Title    string              `json:"title"`
+	SubTitle string              `json:"subTitle"`
+	MixType  string              `json:"mixType"`
+	Images   map[string]MixImage `json:"images"`
+
+	Tracks []Track `json:"-"`
+}
+
+// GetArt fetches the largest image of the mix
+func (m *Mix) GetArt() ([]byte, error) {
+	var best MixImage
+	for _, img := range m.Images {
+		if img.Width > best.Width {
+			best = img
+		}
+	}
+
+	if best.URL == "" {
+		return nil, errors.New("mix has no images")
+	}
+
+	return fetch(best.URL)
+}
+
+// GetMix func
+func (t *Tidal) GetMix(id string) (Mix, error) {
+	var s struct {
+		Title string `json:"title"`
+		Rows  []struct {
+			Modules []struct {
+				Type string `json:"type"`
+				Mix  Mix    `json:"mix"`
+			} `json:"modules"`
+		} `json:"rows"`
+	}
+
+	err := t.get("pages/mix", &url.Values{
+		"mixId":      {id},
+		"deviceType": {"BROWSER"},
+	}, &s)
+	if err != nil {
+		return Mix{}, err
+	}
+
+	for _, row := range s.Rows {
+		for _, module := range row.Modules {
+			if module.Mix.ID != "" {
+				return module.Mix, nil
+			}
+		}
+	}
+
+	return Mix{ID: id, Title: s.Title}, errors.New("mix unavailable")
+}
+
+// GetMixItems func
+func (t *Tidal) GetMixItems(id string) ([]Track, error) {
+	var tracks []Track
+
+	err := t.getPages("mixes/"+id+"/items", url.Values{}, func(raw json.RawMessage) error {
+		var item struct {
+			Item Track  `json:"item"`
+			Type string `json:"type"`
+		}
+
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return err
+		}
+
+		if item.Type == "track" {
+			tracks = append(tracks, item.Item)
+		}
+
+		return nil
+	})
+
+	return tracks, err
+}
+
+// GetTrackRadio func
+func (t *Tidal) GetTrackRadio(id string, l int) ([]Track, error) {
+	return t.getRadio("tracks/"+id+"/radio", l)
+}
+
+// GetArtistRadio func
+func (t *Tidal) GetArtistRadio(id string, l int) ([]Track, error) {
+	return t.getRadio("artists/"+id+"/radio", l)
+}
+
+func (t *Tidal) getRadio(dest string, l int) ([]Track, error) {
+	var s struct {
+		Items []Track `json:"items"`
+	}
+
+	var limit string
+	if l > 0 {
+		limit = strconv.Itoa(l)
+	}
+
+	return s.Items, t.get(dest, &url.Values{
+		"limit": {limit},
+	}, &s)
+}
+
+// DownloadMix snapshots the current contents of a mix into a dated folder
+func (t *Tidal) DownloadMix(m Mix) error {
+	if len(m.Tracks) == 0 {
+		var err error
+		m.Tracks, err = t.GetMixItems(m.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(m.Tracks) == 0 {
+		return errors.New("mix unavailable")
+	}
+
+	// mixes are tagged like playlists so the snapshot date ends up in ALBUM
+	p := Playlist{
+		ID:             m.ID,
+		Title:          m.Title,
+		Snapshot:       time.Now().Format("2006-01-02"),
+		Description:    m.SubTitle,
+		Type:           m.MixType,
+		NumberOfTracks: len(m.Tracks),
+		Tracks:         m.Tracks,
+	}
+
+	for _, tr := range m.Tracks {
+		d, _ := tr.Duration.Int64()
+		p.Duration += int(d)
+	}
+
+	// art is nice to have but not worth failing the snapshot over
+	art, _ := m.GetArt()
+
+	return t.downloadPlaylist(t.mixTemplate(), p, art)
+}
@@ -0,0 +1,659 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNotMP4 is returned when a file has no moov box
+var ErrNotMP4 = errors.New("not an mp4 file")
+
+// well known ilst atoms, the © is a single 0xa9 byte and not utf-8
+const (
+	mp4Title       = "\xa9nam"
+	mp4Artist      = "\xa9ART"
+	mp4AlbumArtist = "aART"
+	mp4Album       = "\xa9alb"
+	mp4Date        = "\xa9day"
+	mp4Composer    = "\xa9wrt"
+	mp4Lyrics      = "\xa9lyr"
+	mp4Copyright   = "cprt"
+	mp4Track       = "trkn"
+	mp4Disc        = "disk"
+	mp4Cover       = "covr"
+	mp4Rating      = "rtng"
+	mp4Tempo       = "tmpo"
+	mp4Freeform    = "----"
+)
+
+// data atom types
+const (
+	mp4Implicit = 0
+	mp4UTF8     = 1
+	mp4JPEG     = 13
+	mp4PNG      = 14
+	mp4Integer  = 21
+)
+
+// iTunes keeps its freeform tags under this mean
+const mp4ITunes = "com.apple.iTunes"
+
+// mp4Item is a single value in the ilst box. Key is the atom name or
+// "----:<mean>:<name>" for freeform atoms. Items sharing a key are written
+// into one atom.
+type mp4Item struct {
+	Key  string
+	Type uint32
+	Data []byte
+}
+
+func mp4Text(key, value string) mp4Item {
+	return mp4Item{Key: key, Type: mp4UTF8, Data: []byte(value)}
+}
+
+func mp4FreeformKey(name string) string {
+	return mp4Freeform + ":" + mp4ITunes + ":" + name
+}
+
+type mp4Box struct {
+	typ   string
+	start int
+	hdr   int
+	end   int
+}
+
+func (b mp4Box) body(data []byte) []byte {
+	return data[b.start+b.hdr : b.end]
+}
+
+// readBoxes splits data into consecutive boxes
+func readBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+
+	for off := 0; off < len(data); {
+		if len(data)-off < 8 {
+			// quicktime ends some udta boxes with a 32 bit zero
+			if bytes.Count(data[off:], []byte{0}) == len(data)-off {
+				break
+			}
+			return nil, errors.New("mp4: truncated box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[off:]))
+		box := mp4Box{typ: string(data[off+4 : off+8]), start: off, hdr: 8}
+
+		switch size {
+		case 0:
+			size = uint64(len(data) - off)
+		case 1:
+			if len(data)-off < 16 {
+				return nil, errors.New("mp4: truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[off+8:])
+			box.hdr = 16
+		}
+
+		if size < uint64(box.hdr) || size > uint64(len(data)-off) {
+			return nil, fmt.Errorf("mp4: bad size for %q box", box.typ)
+		}
+
+		box.end = off + int(size)
+		boxes = append(boxes, box)
+		off = box.end
+	}
+
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, box := range boxes {
+		if box.typ == typ {
+			return box, true
+		}
+	}
+
+	return mp4Box{}, false
+}
+
+func makeBox(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+// metaChildren returns the children of a udta/meta box, which is a full box
+// in iTunes files but a plain container in some quicktime files
+func metaChildren(body []byte) ([]byte, []byte) {
+	if len(body) >= 8 && string(body[4:8]) == "hdlr" {
+		return nil, body
+	}
+
+	if len(body) < 4 {
+		return []byte{0, 0, 0, 0}, nil
+	}
+
+	return body[:4], body[4:]
+}
+
+// mp4HasVideo reports whether any track has a video handler
+func mp4HasVideo(data []byte) bool {
+	found := false
+
+	walkBoxes(data, func(path string, box mp4Box) {
+		body := box.body(data)
+		if path == "moov/trak/mdia/hdlr" && len(body) >= 12 && string(body[8:12]) == "vide" {
+			found = true
+		}
+	})
+
+	return found
+}
+
+// containers walkBoxes descends into
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+	"edts": true, "mvex": true, "moof": true, "traf": true,
+}
+
+// walkBoxes calls fn for every box reachable through mp4Containers with its
+// slash separated path
+func walkBoxes(data []byte, fn func(path string, box mp4Box)) error {
+	var walk func(prefix string, start, end int) error
+	walk = func(prefix string, start, end int) error {
+		boxes, err := readBoxes(data[start:end])
+		if err != nil {
+			return err
+		}
+
+		for _, box := range boxes {
+			box.start += start
+			box.end += start
+
+			path := prefix + box.typ
+			fn(path, box)
+
+			if mp4Containers[box.typ] {
+				if err := walk(path+"/", box.start+box.hdr, box.end); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walk("", 0, len(data))
+}
+
+// readMP4Items returns the ilst items of an mp4 file
+func readMP4Items(data []byte) ([]mp4Item, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil, ErrNotMP4
+	}
+
+	ilst, err := findIlst(moov.body(data))
+	if err != nil || ilst == nil {
+		return nil, err
+	}
+
+	boxes, err := readBoxes(ilst)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []mp4Item
+	for _, box := range boxes {
+		key, values, err := parseIlstAtom(box.body(ilst), box.typ)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range values {
+			v.Key = key
+			items = append(items, v)
+		}
+	}
+
+	return items, nil
+}
+
+// findIlst returns the body of moov/udta/meta/ilst, nil if there is none
+func findIlst(moov []byte) ([]byte, error) {
+	path := []string{"udta", "meta", "ilst"}
+	data := moov
+
+	for _, typ := range path {
+		boxes, err := readBoxes(data)
+		if err != nil {
+			return nil, err
+		}
+
+		box, ok := findBox(boxes, typ)
+		if !ok {
+			return nil, nil
+		}
+
+		data = box.body(data)
+		if typ == "meta" {
+			_, data = metaChildren(data)
+		}
+	}
+
+	return data, nil
+}
+
+// parseIlstAtom returns the key and data values of a single ilst atom
+func parseIlstAtom(body []byte, typ string) (string, []mp4Item, error) {
+	boxes, err := readBoxes(body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := typ
+	var values []mp4Item
+
+	for _, box := range boxes {
+		b := box.body(body)
+		if len(b) < 4 {
+			continue
+		}
+
+		switch box.typ {
+		case "mean":
+			key += ":" + string(b[4:])
+		case "name":
+			key += ":" + string(b[4:])
+		case "data":
+			if len(b) < 8 {
+				return "", nil, errors.New("mp4: truncated data atom")
+			}
+			values = append(values, mp4Item{
+				Type: binary.BigEndian.Uint32(b) & 0xffffff,
+				Data: b[8:],
+			})
+		}
+	}
+
+	return key, values, nil
+}
+
+// renderIlstAtom renders all values of key into one atom
+func renderIlstAtom(key string, values []mp4Item) []byte {
+	var children [][]byte
+
+	typ := key
+	if strings.HasPrefix(key, mp4Freeform+":") {
+		parts := strings.SplitN(key, ":", 3)
+		typ = mp4Freeform
+		children = append(children,
+			makeBox("mean", []byte{0, 0, 0, 0}, []byte(parts[1])),
+			makeBox("name", []byte{0, 0, 0, 0}, []byte(parts[2])))
+	}
+
+	for _, v := range values {
+		head := make([]byte, 8)
+		binary.BigEndian.PutUint32(head, v.Type)
+		children = append(children, makeBox("data", head, v.Data))
+	}
+
+	return makeBox(typ, children...)
+}
+
+// editMP4 writes items into the mp4 at path. Like editFlac it edits what a
+// symlink points at and replaces it through replaceFile.
+func editMP4(path string, items []mp4Item) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if data, err = tagMP4(data, items); err != nil {
+		return err
+	}
+
+	return replaceFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// tagMP4 returns a copy of data with items written into moov/udta/meta/ilst.
+// Existing atoms with a key in items are replaced, everything else is kept.
+// Chunk offsets are fixed up when moov grows or shrinks in front of mdat.
+func tagMP4(data []byte, items []mp4Item) ([]byte, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil, ErrNotMP4
+	}
+
+	var keys []string
+	grouped := make(map[string][]mp4Item)
+	for _, item := range items {
+		if _, ok := grouped[item.Key]; !ok {
+			keys = append(keys, item.Key)
+		}
+		grouped[item.Key] = append(grouped[item.Key], item)
+	}
+
+	newMoov, err := rebuildMoov(moov.body(data), keys, grouped)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := int64(len(newMoov)) - int64(moov.end-moov.start)
+
+	out := make([]byte, 0, len(data)+len(newMoov))
+	out = append(out, data[:moov.start]...)
+	out = append(out, newMoov...)
+	out = append(out, data[moov.end:]...)
+
+	if delta != 0 {
+		err = shiftOffsets(out, int64(moov.end), delta)
+	}
+
+	return out, err
+}
+
+func rebuildMoov(moov []byte, keys []string, grouped map[string][]mp4Item) ([]byte, error) {
+	children, err := readBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	var udta, meta []byte
+	if box, ok := findBox(children, "udta"); ok {
+		udta = box.body(moov)
+	}
+
+	udtaChildren, err := readBoxes(udta)
+	if err != nil {
+		return nil, err
+	}
+
+	var metaHead []byte
+	if box, ok := findBox(udtaChildren, "meta"); ok {
+		metaHead, meta = metaChildren(box.body(udta))
+	}
+
+	metaBoxes, err := readBoxes(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	var ilst []byte
+	if box, ok := findBox(metaBoxes, "ilst"); ok {
+		ilst = box.body(meta)
+	}
+
+	ilstBoxes, err := readBoxes(ilst)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep existing atoms in place, replacing the ones we have values for
+	var newIlst [][]byte
+	written := make(map[string]bool)
+
+	for _, box := range ilstBoxes {
+		key, _, err := parseIlstAtom(box.body(ilst), box.typ)
+		if err != nil {
+			return nil, err
+		}
+
+		values, replace := grouped[key]
+		switch {
+		case !replace:
+			newIlst = append(newIlst, ilst[box.start:box.end])
+		case !written[key]:
+			written[key] = true
+			newIlst = append(newIlst, renderIlstAtom(key, values))
+		}
+	}
+
+	for _, key := range keys {
+		if !written[key] {
+			newIlst = append(newIlst, renderIlstAtom(key, grouped[key]))
+		}
+	}
+
+	ilstBox := makeBox("ilst", newIlst...)
+
+	var newMeta [][]byte
+	if metaHead == nil && meta == nil {
+		metaHead = []byte{0, 0, 0, 0}
+		newMeta = append(newMeta, makeBox("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9)))
+	}
+
+	newMeta = append(newMeta, replaceBox(meta, metaBoxes, "ilst", ilstBox)...)
+	metaBox := makeBox("meta", append([][]byte{metaHead}, newMeta...)...)
+	udtaBox := makeBox("udta", replaceBox(udta, udtaChildren, "meta", metaBox)...)
+
+	return makeBox("moov", replaceBox(moov, children, "udta", udtaBox)...), nil
+}
+
+// replaceBox returns the raw boxes with the first typ box swapped for
+// replacement, which is appended if there was none
+func replaceBox(data []byte, boxes []mp4Box, typ string, replacement []byte) [][]byte {
+	var out [][]byte
+	replaced := false
+
+	for _, box := range boxes {
+		if box.typ == typ && !replaced {
+			replaced = true
+			out = append(out, replacement)
+			continue
+		}
+		out = append(out, data[box.start:box.end])
+	}
+
+	if !replaced {
+		out = append(out, replacement)
+	}
+
+	return out
+}
+
+// shiftOffsets moves every absolute file offset at or past from by delta:
+// stco/co64 chunk offsets and explicit tfhd base offsets of fragments
+func shiftOffsets(data []byte, from, delta int64) error {
+	var err error
+
+	walkBoxes(data, func(path string, box mp4Box) {
+		body := box.body(data)
+
+		switch box.typ {
+		case "stco":
+			if len(body) < 8 {
+				return
+			}
+			n := int(binary.BigEndian.Uint32(body[4:]))
+			for i := 0; i < n && 8+i*4+4 <= len(body); i++ {
+				p := body[8+i*4:]
+				off := int64(binary.BigEndian.Uint32(p))
+				if off < from {
+					continue
+				}
+				if off+delta > 0xffffffff {
+					err = errors.New("mp4: chunk offset overflows stco")
+					return
+				}
+				binary.BigEndian.PutUint32(p, uint32(off+delta))
+			}
+		case "co64":
+			if len(body) < 8 {
+				return
+			}
+			n := int(binary.BigEndian.Uint32(body[4:]))
+			for i := 0; i < n && 8+i*8+8 <= len(body); i++ {
+				p := body[8+i*8:]
+				if off := int64(binary.BigEndian.Uint64(p)); off >= from {
+					binary.BigEndian.PutUint64(p, uint64(off+delta))
+				}
+			}
+		case "tfhd":
+			// base-data-offset-present
+			if len(body) >= 16 && binary.BigEndian.Uint32(body)&0x1 != 0 {
+				p := body[8:]
+				if off := int64(binary.BigEndian.Uint64(p)); off >= from {
+					binary.BigEndian.PutUint64(p, uint64(off+delta))
+				}
+			}
+		}
+	})
+
+	return err
+}
+
+// vorbis comment names of the ilst text atoms, for showing and looking up MP4
+// tags like FLAC ones
+var mp4TagNames = map[string]string{
+	mp4Title:       "TITLE",
+	mp4Artist:      "ARTIST",
+	mp4AlbumArtist: "ALBUMARTIST",
+	mp4Album:       "ALBUM",
+	mp4Date:        "DATE",
+	mp4Composer:    "COMPOSER",
+	mp4Lyrics:      "LYRICS",
+	mp4Copyright:   "COPYRIGHT",
+}
+
+// mp4Tags lists ilst items as vorbis comments, freeform atoms by their name.
+// Cover art and atoms we don't know are left out.
+func mp4Tags(items []mp4Item) Tags {
+	var tags Tags
+
+	integer := func(data []byte) string {
+		var n uint64
+		for _, b := range data {
+			n = n<<8 | uint64(b)
+		}
+		return strconv.FormatUint(n, 10)
+	}
+
+	for _, item := range items {
+		switch {
+		case item.Key == mp4Track || item.Key == mp4Disc:
+			if len(item.Data) < 6 {
+				continue
+			}
+
+			number, total := "TRACKNUMBER", "TRACKTOTAL"
+			if item.Key == mp4Disc {
+				number, total = "DISCNUMBER", "DISCTOTAL"
+			}
+
+			if n := binary.BigEndian.Uint16(item.Data[2:]); n > 0 {
+				tags.Add(number, strconv.Itoa(int(n)))
+			}
+			if n := binary.BigEndian.Uint16(item.Data[4:]); n > 0 {
+				tags.Add(total, strconv.Itoa(int(n)))
+			}
+		case item.Key == mp4Tempo:
+			tags.Add("BPM", integer(item.Data))
+		case item.Key == mp4Rating:
+			tags.Add("ITUNESADVISORY", integer(item.Data))
+		case item.Type != mp4UTF8:
+		case mp4TagNames[item.Key] != "":
+			tags.Add(mp4TagNames[item.Key], string(item.Data))
+		case strings.HasPrefix(item.Key, mp4Freeform+":"):
+			tags.Add(item.Key[strings.LastIndexByte(item.Key, ':')+1:], string(item.Data))
+		}
+	}
+
+	return tags
+}
+
+// mp4Items builds the ilst tags of a track
+func (t *Tidal) mp4Items(tr Track) []mp4Item {
+	var items []mp4Item
+	text := func(key, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			items = append(items, mp4Text(key, value))
+		}
+	}
+
+	text(mp4Title, tr.titleName())
+	text(mp4Artist, tr.artistName())
+	text(mp4AlbumArtist, t.ArtistFormat.albumArtists(tr.Album))
+	text(mp4Album, tr.albumName())
+
+	number, _ := strconv.Atoi(tr.TrackNumber.String())
+	total, _ := strconv.Atoi(tr.trackTotal())
+	items = append(items, mp4Item{Key: mp4Track, Type: mp4Implicit, Data: []byte{
+		0, 0, byte(number >> 8), byte(number), byte(total >> 8), byte(total), 0, 0,
+	}})
+
+	if tr.Playlist.ID == "" {
+		disc, _ := strconv.Atoi(tr.disc())
+		discs, _ := strconv.Atoi(tr.discTotal())
+		items = append(items, mp4Item{Key: mp4Disc, Type: mp4Implicit, Data: []byte{
+			0, 0, byte(disc >> 8), byte(disc), byte(discs >> 8), byte(discs),
+		}})
+	}
+
+	text(mp4Copyright, tr.Copyright)
+
+	for _, tag := range tr.metadataTags() {
+		switch tag[0] {
+		case "DATE":
+			text(mp4Date, tag[1])
+		case "COMPOSER":
+			text(mp4Composer, tag[1])
+		case "BPM":
+			bpm, _ := strconv.Atoi(tag[1])
+			items = append(items, mp4Item{Key: mp4Tempo, Type: mp4Integer, Data: []byte{byte(bpm >> 8), byte(bpm)}})
+		default:
+			text(mp4FreeformKey(tag[0]), tag[1])
+		}
+	}
+
+	text(mp4Lyrics, tr.lyrics.Unsynced())
+
+	if advisory := tr.advisory(); advisory != "" {
+		rating, _ := strconv.Atoi(advisory)
+		items = append(items, mp4Item{Key: mp4Rating, Type: mp4Integer, Data: []byte{byte(rating)}})
+	}
+
+	if cover := tr.Album.cover(); len(cover) > 0 {
+		typ := uint32(mp4JPEG)
+		if bytes.HasPrefix(cover, []byte("\x89PNG")) {
+			typ = mp4PNG
+		}
+		items = append(items, mp4Item{Key: mp4Cover, Type: typ, Data: cover})
+	}
+
+	return items
+}
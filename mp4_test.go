@@ -0,0 +1,326 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the payloads chunk offsets point at, four bytes each
+var mp4Chunks = [][]byte{[]byte("AAAA"), []byte("BBBB"), []byte("CCCC")}
+
+func fullBox(typ string, payload ...[]byte) []byte {
+	return makeBox(typ, append([][]byte{{0, 0, 0, 0}}, payload...)...)
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// chunkTable renders an stco or co64 box pointing at offsets
+func chunkTable(typ string, offsets []int64) []byte {
+	payload := [][]byte{u32(uint32(len(offsets)))}
+	for _, off := range offsets {
+		if typ == "co64" {
+			payload = append(payload, u64(uint64(off)))
+		} else {
+			payload = append(payload, u32(uint32(off)))
+		}
+	}
+
+	return fullBox(typ, payload...)
+}
+
+func audioTrak(table []byte) []byte {
+	hdlr := fullBox("hdlr", u32(0), []byte("soun"), make([]byte, 13))
+	return makeBox("trak", makeBox("mdia", hdlr, makeBox("minf", makeBox("stbl", table))))
+}
+
+// mdatBox puts mp4Chunks in an mdat after some filler so no offset is zero
+func mdatBox() []byte {
+	return makeBox("mdat", []byte("filler"), bytes.Join(mp4Chunks, nil))
+}
+
+// chunkStarts returns where the chunks start in a file whose mdat begins at
+// off
+func chunkStarts(off int) []int64 {
+	var starts []int64
+	for i := range mp4Chunks {
+		starts = append(starts, int64(off+8+len("filler")+4*i))
+	}
+	return starts
+}
+
+// plainMP4 is ftyp, moov, mdat with an stco or co64 table. The tables point
+// at the mdat, so they're built twice, once to learn the moov size.
+func plainMP4(typ string, udta []byte) []byte {
+	ftyp := makeBox("ftyp", []byte("M4A "), u32(0), []byte("M4A isom"))
+	mvhd := fullBox("mvhd", make([]byte, 96))
+
+	moov := func(offsets []int64) []byte {
+		children := [][]byte{mvhd, audioTrak(chunkTable(typ, offsets))}
+		if udta != nil {
+			children = append(children, udta)
+		}
+		return makeBox("moov", children...)
+	}
+
+	starts := chunkStarts(len(ftyp) + len(moov(make([]int64, len(mp4Chunks)))))
+	return bytes.Join([][]byte{ftyp, moov(starts), mdatBox()}, nil)
+}
+
+// fragmentedMP4 is ftyp, moov with mvex, then a moof whose tfhd has an
+// explicit base data offset pointing at the mdat after it
+func fragmentedMP4() []byte {
+	ftyp := makeBox("ftyp", []byte("iso6"), u32(0), []byte("iso6dash"))
+	moov := makeBox("moov",
+		fullBox("mvhd", make([]byte, 96)),
+		audioTrak(chunkTable("stco", nil)),
+		makeBox("mvex", fullBox("trex", make([]byte, 20))))
+
+	moof := func(base int64) []byte {
+		tfhd := makeBox("tfhd", u32(0x1), u32(1), u64(uint64(base)))
+		return makeBox("moof", fullBox("mfhd", u32(1)), makeBox("traf", tfhd))
+	}
+
+	start := chunkStarts(len(ftyp) + len(moov) + len(moof(0)))[0]
+	return bytes.Join([][]byte{ftyp, moov, moof(start), mdatBox()}, nil)
+}
+
+// chunkOffsets collects every stco, co64 and tfhd base offset in data
+func chunkOffsets(t *testing.T, data []byte) []int64 {
+	var offsets []int64
+
+	err := walkBoxes(data, func(path string, box mp4Box) {
+		body := box.body(data)
+
+		switch box.typ {
+		case "stco":
+			for i := 0; i < int(binary.BigEndian.Uint32(body[4:])); i++ {
+				offsets = append(offsets, int64(binary.BigEndian.Uint32(body[8+4*i:])))
+			}
+		case "co64":
+			for i := 0; i < int(binary.BigEndian.Uint32(body[4:])); i++ {
+				offsets = append(offsets, int64(binary.BigEndian.Uint64(body[8+8*i:])))
+			}
+		case "tfhd":
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(body[8:])))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return offsets
+}
+
+// checkChunks fails unless every chunk offset in data points at a chunk, in
+// order
+func checkChunks(t *testing.T, data []byte, want int) {
+	t.Helper()
+
+	offsets := chunkOffsets(t, data)
+	if len(offsets) != want {
+		t.Fatalf("got %v chunk offsets, want %v", len(offsets), want)
+	}
+
+	for i, off := range offsets {
+		if got := data[off : off+4]; !bytes.Equal(got, mp4Chunks[i]) {
+			t.Errorf("chunk %v at %v reads %q, want %q", i, off, got, mp4Chunks[i])
+		}
+	}
+}
+
+func mp4ItemsString(items []mp4Item) string {
+	var b bytes.Buffer
+	for _, item := range items {
+		fmt.Fprintf(&b, "%q/%v=%q ", item.Key, item.Type, item.Data)
+	}
+	return b.String()
+}
+
+func TestTagMP4(t *testing.T) {
+	// an existing ilst with a title to replace and a freeform tag to keep
+	existing := makeBox("udta", fullBox("meta",
+		fullBox("hdlr", u32(0), []byte("mdirappl"), make([]byte, 9)),
+		makeBox("ilst",
+			renderIlstAtom(mp4Title, []mp4Item{mp4Text(mp4Title, "Old Title")}),
+			renderIlstAtom(mp4FreeformKey("MOOD"), []mp4Item{mp4Text("", "calm")}))))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		chunks int
+		want   []mp4Item
+	}{
+		{"stco", plainMP4("stco", nil), 3, nil},
+		{"co64", plainMP4("co64", existing), 3, []mp4Item{mp4Text(mp4FreeformKey("MOOD"), "calm")}},
+		{"fragmented", fragmentedMP4(), 1, nil},
+	}
+
+	items := []mp4Item{
+		mp4Text(mp4Title, "A Long Enough Title To Grow The Moov Box"),
+		mp4Text(mp4Artist, "One"),
+		mp4Text(mp4Artist, "Two"),
+		{Key: mp4Track, Data: []byte{0, 0, 0, 3, 0, 12, 0, 0}},
+		mp4Text(mp4FreeformKey("ISRC"), "USABC0100001"),
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkChunks(t, tt.data, tt.chunks)
+
+			tagged, err := tagMP4(tt.data, items)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tagged) <= len(tt.data) {
+				t.Fatalf("moov didn't grow, %v -> %v bytes", len(tt.data), len(tagged))
+			}
+			checkChunks(t, tagged, tt.chunks)
+
+			got, err := readMP4Items(tagged)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// replaced atoms stay where they were, new ones go at the end
+			want := append([]mp4Item{items[0]}, tt.want...)
+			want = append(want, items[1:]...)
+			if mp4ItemsString(got) != mp4ItemsString(want) {
+				t.Errorf("got  %v\nwant %v", mp4ItemsString(got), mp4ItemsString(want))
+			}
+
+			// shrinking back moves the offsets the other way
+			shrunk, err := tagMP4(tagged, []mp4Item{mp4Text(mp4Title, "T")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkChunks(t, shrunk, tt.chunks)
+		})
+	}
+}
+
+func TestTagMP4MoovAfterMdat(t *testing.T) {
+	ftyp := makeBox("ftyp", []byte("M4A "), u32(0), []byte("M4A isom"))
+	moov := makeBox("moov", fullBox("mvhd", make([]byte, 96)), audioTrak(chunkTable("stco", chunkStarts(len(ftyp)))))
+	data := bytes.Join([][]byte{ftyp, mdatBox(), moov}, nil)
+
+	tagged, err := tagMP4(data, []mp4Item{mp4Text(mp4Album, "Album")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkChunks(t, tagged, 3)
+
+	got, err := readMP4Items(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Key != mp4Album || string(got[0].Data) != "Album" {
+		t.Errorf("got %v", mp4ItemsString(got))
+	}
+}
+
+func TestReadMP4ItemsNotMP4(t *testing.T) {
+	if _, err := readMP4Items(makeBox("ftyp", []byte("M4A "))); err != ErrNotMP4 {
+		t.Errorf("got %v, want ErrNotMP4", err)
+	}
+}
+
+func TestMP4Tags(t *testing.T) {
+	items := []mp4Item{
+		mp4Text(mp4Title, "Title"),
+		mp4Text(mp4Artist, "One"),
+		mp4Text(mp4Artist, "Two"),
+		{Key: mp4Track, Data: []byte{0, 0, 0, 3, 0, 12, 0, 0}},
+		{Key: mp4Disc, Data: []byte{0, 0, 0, 1, 0, 0}},
+		{Key: mp4Tempo, Type: mp4Integer, Data: []byte{0, 120}},
+		{Key: mp4Rating, Type: mp4Integer, Data: []byte{1}},
+		mp4Text(mp4FreeformKey("TIDAL_TRACK_ID"), "123"),
+		{Key: mp4Cover, Type: mp4JPEG, Data: []byte{0xff, 0xd8}},
+		{Key: "xxxx", Type: mp4UTF8, Data: []byte("unknown")},
+	}
+
+	want := Tags{
+		{"TITLE", "Title"},
+		{"ARTIST", "One"},
+		{"ARTIST", "Two"},
+		{"TRACKNUMBER", "3"},
+		{"TRACKTOTAL", "12"},
+		{"DISCNUMBER", "1"},
+		{"BPM", "120"},
+		{"ITUNESADVISORY", "1"},
+		{"TIDAL_TRACK_ID", "123"},
+	}
+
+	if got := mp4Tags(items); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestEditMP4Links(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidl-mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "song.m4a")
+	if err := ioutil.WriteFile(path, plainMP4("stco", nil), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	title := func() string {
+		items, err := readMP4Items(mustReadFile(t, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(mp4Tags(items).Get("TITLE"))
+	}
+
+	symlink := filepath.Join(dir, "symlink.m4a")
+	if err := os.Symlink(path, symlink); err == nil {
+		if err := editMP4(symlink, []mp4Item{mp4Text(mp4Title, "Via Symlink")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := os.Lstat(symlink); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("link replaced: %v", err)
+		}
+		if got := title(); got != "[Via Symlink]" {
+			t.Errorf("target not edited, got %v", got)
+		}
+	}
+
+	hardlink := filepath.Join(dir, "hardlink.m4a")
+	if os.Link(path, hardlink) == nil {
+		if err := editMP4(hardlink, []mp4Item{mp4Text(mp4Title, "Via Hardlink")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := title(); got != "[Via Hardlink]" {
+			t.Errorf("links split, got %v", got)
+		}
+		checkChunks(t, mustReadFile(t, path), len(mp4Chunks))
+	}
+
+	for _, p := range []string{path, hardlink} {
+		if _, err := os.Stat(p + ".part"); !os.IsNotExist(err) {
+			t.Errorf("temporary file left behind for %v", p)
+		}
+	}
+}
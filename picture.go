@@ -0,0 +1,149 @@
+package tidl
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	// decoders for image.DecodeConfig
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// picture types from the ID3v2 APIC frame, see meta.Picture
+const (
+	PictureFrontCover uint32 = 3
+	PictureArtist     uint32 = 8
+)
+
+// renditions tidal serves, largest first
+var (
+	coverSizes         = []int{1280, 640, 320, 160, 80}
+	artistPictureSizes = []int{750, 480, 320, 160}
+)
+
+// GetArtURL returns the url of the album cover at the given size
+func (al Album) GetArtURL(size int) string {
+	return fmt.Sprintf("https://resources.tidal.com/images/%v/%vx%v.jpg", strings.Replace(al.Cover, "-", "/", -1), size, size)
+}
+
+// newPicture builds a picture block body, reading the dimensions, depth and
+// mime type from the image itself
+func newPicture(typ uint32, data []byte) (*meta.Picture, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	pic := &meta.Picture{
+		Type:   typ,
+		MIME:   "image/" + format,
+		Width:  uint32(cfg.Width),
+		Height: uint32(cfg.Height),
+		Data:   data,
+	}
+
+	switch model := cfg.ColorModel.(type) {
+	case color.Palette:
+		pic.Depth = 8
+		pic.NPalColors = uint32(len(model))
+	default:
+		pic.Depth = colorDepth[model]
+	}
+
+	if pic.Depth == 0 {
+		pic.Depth = 24
+	}
+
+	return pic, nil
+}
+
+// bits per pixel of the color models the jpeg and png decoders report, png
+// uses RGBA for truecolor without alpha
+var colorDepth = map[color.Model]uint32{
+	color.GrayModel:    8,
+	color.Gray16Model:  16,
+	color.YCbCrModel:   24,
+	color.RGBAModel:    24,
+	color.NRGBAModel:   32,
+	color.CMYKModel:    32,
+	color.RGBA64Model:  48,
+	color.NRGBA64Model: 64,
+}
+
+// fitPicture fetches the largest rendition no bigger than size that is at
+// most maxBytes long, maxBytes 0 means no limit. have is an already fetched
+// rendition of sizes[0].
+func fitPicture(sizes []int, size, maxBytes int, have []byte, url func(int) string) []byte {
+	for _, s := range sizes {
+		if size > 0 && s > size {
+			continue
+		}
+
+		body := have
+		if s != sizes[0] || body == nil {
+			var err error
+			if body, err = fetch(url(s)); err != nil {
+				continue
+			}
+		}
+
+		if maxBytes <= 0 || len(body) <= maxBytes {
+			return body
+		}
+	}
+
+	return nil
+}
+
+// withPictures fills in the pictures to embed into the tracks of al. They
+// are cached in albumMap so every track of an album shares one fetch.
+func (t *Tidal) withPictures(al Album) Album {
+	if al.picturesDone {
+		return al
+	}
+
+	al.picturesDone = true
+
+	if al.Cover != "" {
+		cover := fitPicture(coverSizes, t.CoverSize, t.MaxPictureBytes, al.artBody, al.GetArtURL)
+		if pic, err := newPicture(PictureFrontCover, cover); err == nil {
+			al.pictures = append(al.pictures, pic)
+		}
+	}
+
+	if t.ArtistPicture {
+		artist := al.Artist
+		if artist.Picture == "" && artist.ID.String() != "" {
+			artist, _ = t.GetArtist(artist.ID.String())
+		}
+
+		if artist.Picture != "" {
+			body := fitPicture(artistPictureSizes, 0, t.MaxPictureBytes, nil, artist.GetPictureURL)
+			if pic, err := newPicture(PictureArtist, body); err == nil {
+				al.pictures = append(al.pictures, pic)
+			}
+		}
+	}
+
+	if al.ID.String() != "" {
+		t.albumMap[al.ID.String()] = al
+	}
+
+	return al
+}
+
+// cover returns the front cover to embed, if any
+func (al Album) cover() []byte {
+	for _, pic := range al.pictures {
+		if pic.Type == PictureFrontCover {
+			return pic.Data
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package tidl
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestNewPicture(t *testing.T) {
+	rect := image.Rect(0, 0, 4, 3)
+
+	opaque := image.NewRGBA(rect)
+	draw.Draw(opaque, rect, image.NewUniform(color.RGBA{10, 20, 30, 255}), image.Point{}, draw.Src)
+
+	translucent := image.NewNRGBA(rect)
+	translucent.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, opaque, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		mime   string
+		depth  uint32
+		colors uint32
+	}{
+		{"jpeg", jpg.Bytes(), "image/jpeg", 24, 0},
+		{"opaque png", encodePNG(t, opaque), "image/png", 24, 0},
+		{"alpha png", encodePNG(t, translucent), "image/png", 32, 0},
+		{"gray png", encodePNG(t, image.NewGray(rect)), "image/png", 8, 0},
+		{"paletted png", encodePNG(t, image.NewPaletted(rect, palette.Plan9[:16])), "image/png", 8, 16},
+	}
+
+	for _, tt := range tests {
+		pic, err := newPicture(PictureFrontCover, tt.data)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+
+		got := fmt.Sprint(pic.Type, pic.MIME, pic.Width, pic.Height, pic.Depth, pic.NPalColors)
+		want := fmt.Sprint(PictureFrontCover, tt.mime, 4, 3, tt.depth, tt.colors)
+		if got != want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, want)
+		}
+	}
+
+	if _, err := newPicture(PictureFrontCover, []byte("not an image")); err == nil {
+		t.Error("decoded garbage")
+	}
+}
+
+func TestFitPicture(t *testing.T) {
+	// renditions are size*4 bytes long
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		size, _ := strconv.Atoi(strings.Trim(r.URL.Path, "/"))
+		w.Write(make([]byte, size*4))
+	}))
+	defer srv.Close()
+
+	url := func(size int) string { return fmt.Sprintf("%v/%v", srv.URL, size) }
+	have := make([]byte, 1280*4)
+
+	tests := []struct {
+		size, maxBytes int
+		have           []byte
+		want           int
+		fetched        string
+	}{
+		{0, 0, have, 1280 * 4, "[]"},
+		{0, 0, nil, 1280 * 4, "[/1280]"},
+		{640, 0, have, 640 * 4, "[/640]"},
+		{0, 1000, have, 160 * 4, "[/640 /320 /160]"},
+		{0, 100, have, 0, "[/640 /320 /160 /80]"},
+	}
+
+	for _, tt := range tests {
+		fetched = nil
+
+		got := fitPicture(coverSizes, tt.size, tt.maxBytes, tt.have, url)
+		if len(got) != tt.want || fmt.Sprint(fetched) != tt.fetched {
+			t.Errorf("size %v max %v: got %v bytes fetching %v, want %v fetching %v",
+				tt.size, tt.maxBytes, len(got), fetched, tt.want, tt.fetched)
+		}
+	}
+}
+
+func TestSetPictures(t *testing.T) {
+	picture := func(typ uint32, data string) *meta.Block {
+		return &meta.Block{
+			Header: meta.Header{Type: meta.TypePicture},
+			Body:   &meta.Picture{Type: typ, Data: []byte(data)},
+		}
+	}
+
+	stream := &flac.Stream{Blocks: []*meta.Block{
+		picture(PictureFrontCover, "old cover"),
+		{Header: meta.Header{Type: meta.TypeVorbisComment}, Body: &meta.VorbisComment{}},
+		picture(0, "other"),
+	}}
+
+	setPictures(stream, []*meta.Picture{{Type: PictureFrontCover, Data: []byte("new cover")}})
+
+	var got []string
+	for _, block := range stream.Blocks {
+		if pic, ok := block.Body.(*meta.Picture); ok {
+			got = append(got, fmt.Sprintf("%v:%s", pic.Type, pic.Data))
+		}
+	}
+
+	if want := "[0:other 3:new cover]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PlaylistFormat is a playlist file format
+type PlaylistFormat string
+
+const (
+	// PlaylistM3U8 is extended m3u in utf-8 with #EXTINF durations
+	PlaylistM3U8 PlaylistFormat = "m3u8"
+	// PlaylistXSPF is the xml shareable playlist format
+	PlaylistXSPF PlaylistFormat = "xspf"
+	// PlaylistPLS is the ini style format winamp and friends read
+	PlaylistPLS PlaylistFormat = "pls"
+)
+
+// ParsePlaylistFormats parses a comma separated list like "m3u8,xspf", ""
+// and "none" mean no playlist files
+func ParsePlaylistFormats(s string) ([]PlaylistFormat, error) {
+	var formats []PlaylistFormat
+
+	for _, f := range strings.Split(s, ",") {
+		switch f = strings.ToLower(strings.TrimSpace(f)); f {
+		case "", "none":
+		case "m3u", "m3u8":
+			formats = append(formats, PlaylistM3U8)
+		case "xspf":
+			formats = append(formats, PlaylistXSPF)
+		case "pls":
+			formats = append(formats, PlaylistPLS)
+		default:
+			return nil, fmt.Errorf("unknown playlist format: %q", f)
+		}
+	}
+
+	return formats, nil
+}
+
+// playlistEntry is a track in a playlist file, Path is the file on disk
+type playlistEntry struct {
+	Path     string
+	Title    string
+	Artist   string
+	Album    string
+	Duration int
+	Number   int
+}
+
+func newPlaylistEntry(path string, tr Track) playlistEntry {
+	duration, _ := tr.Duration.Int64()
+	number, _ := strconv.Atoi(tr.TrackNumber.String())
+
+	return playlistEntry{
+		Path:     path,
+		Title:    tr.titleName(),
+		Artist:   tr.artistName(),
+		Album:    tr.Album.Title,
+		Duration: int(duration),
+		Number:   number,
+	}
+}
+
+// writePlaylistFiles writes title.<ext> into dir in every format, with paths
+// relative to dir
+func (t *Tidal) writePlaylistFiles(dir, title string, entries []playlistEntry) error {
+	if len(t.PlaylistFormats) == 0 || len(entries) == 0 {
+		return nil
+	}
+
+	rel := make([]playlistEntry, len(entries))
+	for i, entry := range entries {
+		rel[i] = entry
+		if path, err := filepath.Rel(dir, entry.Path); err == nil {
+			rel[i].Path = filepath.ToSlash(path)
+		}
+	}
+
+	name := t.Sanitizer.component(title, extensionReserve)
+
+	for _, format := range t.PlaylistFormats {
+		var data []byte
+		switch format {
+		case PlaylistM3U8:
+			data = renderM3U8(title, rel)
+		case PlaylistXSPF:
+			data = renderXSPF(title, rel)
+		case PlaylistPLS:
+			data = renderPLS(rel)
+		}
+
+		err := ioutil.WriteFile(filepath.Join(dir, name+"."+string(format)), data, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e playlistEntry) display() string {
+	if e.Artist == "" {
+		return e.Title
+	}
+
+	return e.Artist + " - " + e.Title
+}
+
+func renderM3U8(title string, entries []playlistEntry) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%v\n", title)
+
+	for _, e := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%v\n", e.Duration, e.display())
+		fmt.Fprintf(&b, "%v\n", e.Path)
+	}
+
+	return b.Bytes()
+}
+
+func renderPLS(entries []playlistEntry) []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+
+	for i, e := range entries {
+		fmt.Fprintf(&b, "File%d=%v\n", i+1, e.Path)
+		fmt.Fprintf(&b, "Title%d=%v\n", i+1, e.display())
+		fmt.Fprintf(&b, "Length%d=%d\n", i+1, e.Duration)
+	}
+
+	fmt.Fprintf(&b, "NumberOfEntries=%d\n", len(entries))
+	b.WriteString("Version=2\n")
+
+	return b.Bytes()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	NS      string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	TrackNum int    `xml:"trackNum,omitempty"`
+	Duration int    `xml:"duration,omitempty"`
+}
+
+func renderXSPF(title string, entries []playlistEntry) []byte {
+	p := xspfPlaylist{Version: "1", NS: "http://xspf.org/ns/0/", Title: title}
+
+	for _, e := range entries {
+		// locations are uri references, relative ones resolve against the
+		// playlist
+		location := (&url.URL{Path: e.Path}).String()
+
+		p.Tracks = append(p.Tracks, xspfTrack{
+			Location: location,
+			Title:    e.Title,
+			Creator:  e.Artist,
+			Album:    e.Album,
+			TrackNum: e.Number,
+			Duration: e.Duration * 1000,
+		})
+	}
+
+	data, _ := xml.MarshalIndent(p, "", "\t")
+	return append([]byte(xml.Header), append(data, '\n')...)
+}
+
+// audio extensions DownloadTrack writes
+var audioExtensions = []string{".flac", ".m4a", ".mp4"}
+
+// findFile returns the downloaded file of tr, "" if there is none
+func (tr Track) findFile(root string, tmpl *Template) string {
+	path := tr.GetPath(root, tmpl)
+	matches, _ := filepath.Glob(globEscape(path) + ".*")
+
+	for _, match := range matches {
+		for _, ext := range audioExtensions {
+			if strings.EqualFold(filepath.Ext(match), ext) {
+				return match
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,151 @@
+package tidl
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testEntries = []playlistEntry{
+	{Path: "CD1/01 Intro.flac", Title: "Intro", Artist: "Band", Album: "Live", Duration: 61, Number: 1},
+	{Path: "../Other/Song #1: Ünïcode.m4a", Title: "Song #1", Album: "Other", Duration: 200, Number: 4},
+}
+
+func TestRenderM3U8(t *testing.T) {
+	want := "#EXTM3U\n" +
+		"#PLAYLIST:Mine\n" +
+		"#EXTINF:61,Band - Intro\n" +
+		"CD1/01 Intro.flac\n" +
+		"#EXTINF:200,Song #1\n" +
+		"../Other/Song #1: Ünïcode.m4a\n"
+
+	if got := string(renderM3U8("Mine", testEntries)); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRenderPLS(t *testing.T) {
+	want := "[playlist]\n" +
+		"File1=CD1/01 Intro.flac\n" +
+		"Title1=Band - Intro\n" +
+		"Length1=61\n" +
+		"File2=../Other/Song #1: Ünïcode.m4a\n" +
+		"Title2=Song #1\n" +
+		"Length2=200\n" +
+		"NumberOfEntries=2\n" +
+		"Version=2\n"
+
+	if got := string(renderPLS(testEntries)); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRenderXSPF(t *testing.T) {
+	var p xspfPlaylist
+	if err := xml.Unmarshal(renderXSPF("Mine & Yours", testEntries), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Title != "Mine & Yours" || len(p.Tracks) != 2 {
+		t.Fatalf("got %+v", p)
+	}
+
+	want := []xspfTrack{
+		{Location: "CD1/01%20Intro.flac", Title: "Intro", Creator: "Band", Album: "Live", TrackNum: 1, Duration: 61000},
+		{Location: "../Other/Song%20%231:%20%C3%9Cn%C3%AFcode.m4a", Title: "Song #1", Album: "Other", TrackNum: 4, Duration: 200000},
+	}
+
+	for i, tr := range p.Tracks {
+		if tr != want[i] {
+			t.Errorf("track %v: got %+v, want %+v", i, tr, want[i])
+		}
+	}
+}
+
+func TestParsePlaylistFormats(t *testing.T) {
+	tests := map[string]string{
+		"":               "[]",
+		"none":           "[]",
+		"m3u":            "[m3u8]",
+		"M3U8, xspf,pls": "[m3u8 xspf pls]",
+	}
+
+	for in, want := range tests {
+		if got, err := ParsePlaylistFormats(in); err != nil || fmt.Sprint(got) != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	if _, err := ParsePlaylistFormats("m3u8,bogus"); err == nil {
+		t.Error("bogus parsed")
+	}
+}
+
+func TestWritePlaylistFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "tidl-playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "Playlists", "Mine")
+	os.MkdirAll(dir, os.ModePerm)
+
+	entries := []playlistEntry{
+		{Path: filepath.Join(dir, "01 Here.flac"), Title: "Here"},
+		{Path: filepath.Join(root, "Band", "Album", "02 There.flac"), Title: "There"},
+	}
+
+	td := &Tidal{PlaylistFormats: []PlaylistFormat{PlaylistM3U8, PlaylistPLS}}
+	if err := td.writePlaylistFiles(dir, "Mine: Best/Of", entries); err != nil {
+		t.Fatal(err)
+	}
+
+	m3u, err := ioutil.ReadFile(filepath.Join(dir, "Mine: Best∕Of.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "#EXTM3U\n#PLAYLIST:Mine: Best/Of\n#EXTINF:0,Here\n01 Here.flac\n#EXTINF:0,There\n../../Band/Album/02 There.flac\n"
+	if string(m3u) != want {
+		t.Errorf("got\n%s\nwant\n%v", m3u, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "Mine: Best∕Of.pls")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "tidl-playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tmpl := MustParseTemplate("{album}/{title}")
+	tracks := []Track{
+		{Title: "Song [Live]", Album: Album{Title: "Album"}},
+		{Title: "Loud", Album: Album{Title: "Album"}},
+		{Title: "Missing", Album: Album{Title: "Album"}},
+		{Title: "Cover", Album: Album{Title: "Album"}},
+	}
+
+	writeSyncTree(t, root, "Album/Song [Live].flac", "Album/Loud.M4A", "Album/Cover.jpg")
+
+	want := []string{"Album/Song [Live].flac", "Album/Loud.M4A", "", ""}
+	for i, tr := range tracks {
+		got := tr.findFile(root, tmpl)
+		if got != "" {
+			got, _ = filepath.Rel(root, got)
+			got = filepath.ToSlash(got)
+		}
+
+		if got != want[i] {
+			t.Errorf("%v: got %q, want %q", tr.Title, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tidl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlaylistMode decides where the tracks of a playlist end up
+type PlaylistMode int
+
+const (
+	// PlaylistCopy downloads tracks into the playlist folder, tagged with the
+	// playlist as album and numbered by position
+	PlaylistCopy PlaylistMode = iota
+	// PlaylistReuse points at tracks already in the album library and copies
+	// the rest
+	PlaylistReuse
+	// PlaylistLibrary downloads tracks once into their album location with
+	// album tags, the playlist folder only gets playlist files
+	PlaylistLibrary
+	// PlaylistSymlink is PlaylistLibrary plus relative symlinks in the
+	// playlist folder
+	PlaylistSymlink
+	// PlaylistHardlink is PlaylistLibrary plus hardlinks in the playlist
+	// folder
+	PlaylistHardlink
+)
+
+// ParsePlaylistMode parses "copy", "reuse", "library", "symlink" or "hardlink"
+func ParsePlaylistMode(s string) (PlaylistMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "copy":
+		return PlaylistCopy, nil
+	case "reuse":
+		return PlaylistReuse, nil
+	case "library", "none":
+		return PlaylistLibrary, nil
+	case "symlink", "link":
+		return PlaylistSymlink, nil
+	case "hardlink":
+		return PlaylistHardlink, nil
+	}
+
+	return PlaylistCopy, fmt.Errorf("unknown playlist mode: %q", s)
+}
+
+// libraryFile returns the file of tr in the album library, "" if it hasn't
+// been downloaded there
+func (t *Tidal) libraryFile(tr Track) string {
+	at, err := t.albumTrack(tr)
+	if err != nil {
+		return ""
+	}
+
+	return at.findFile(t.Root, t.albumTemplate())
+}
+
+// playlistLink downloads src into the album library and links it into the
+// playlist folder as tr, depending on the mode. It returns the path the
+// playlist file should point at.
+func (t *Tidal) playlistLink(tmpl *Template, tr, src Track) (string, error) {
+	at, err := t.albumTrack(src)
+	if err != nil {
+		return "", err
+	}
+
+	albumTmpl := t.albumTemplate()
+	if !at.DoExists(t.Root, albumTmpl) {
+		if err := t.DownloadTrack(albumTmpl, at); err != nil {
+			return "", err
+		}
+	}
+
+	target := at.findFile(t.Root, albumTmpl)
+	if target == "" {
+		return "", fmt.Errorf("%v: no file in the library", at.Title)
+	}
+
+	if t.PlaylistMode == PlaylistLibrary {
+		return target, nil
+	}
+
+	link := tr.GetPath(t.Root, tmpl) + filepath.Ext(target)
+	if _, err := os.Lstat(link); err == nil {
+		return link, nil
+	}
+
+	os.MkdirAll(filepath.Dir(link), os.ModePerm)
+
+	if t.PlaylistMode == PlaylistSymlink {
+		// relative so the library can be moved or mounted elsewhere
+		rel, relErr := filepath.Rel(filepath.Dir(link), target)
+		if relErr != nil {
+			rel = target
+		}
+		err = os.Symlink(rel, link)
+	} else {
+		err = os.Link(target, link)
+	}
+
+	// a playlist pointing at the library beats no entry at all
+	if err != nil {
+		return target, err
+	}
+
+	return link, nil
+}
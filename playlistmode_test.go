@@ -0,0 +1,189 @@
+package tidl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// discAPI serves the tracks of discAlbum, playlists only carry the album id
+// so albumTrack has to fetch the rest
+func discAPI(t *testing.T) (*Tidal, []Track) {
+	al, tracks := discAlbum()
+
+	td := testAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/albums/1/tracks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": tracks})
+		case strings.HasSuffix(r.URL.Path, "/credits"):
+			w.Write([]byte("[]"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	td.albumMap[al.ID.String()] = al
+
+	var listed []Track
+	for _, tr := range tracks {
+		tr.Album = Album{ID: al.ID}
+		listed = append(listed, tr)
+	}
+
+	return td, listed
+}
+
+func TestAlbumTrack(t *testing.T) {
+	td, tracks := discAPI(t)
+
+	want := []struct {
+		path  string
+		total string
+	}{
+		{"Band/Live/CD1/Band - Intro", "3"},
+		{"Band/Live/CD1/Band - Song", "3"},
+		{"Band/Live/CD1/Band - Outro", "3"},
+		{"Band/Live/CD2/Band - Intro", "2"},
+		{"Band/Live/CD2/Band - Song", "2"},
+	}
+
+	for i, tr := range tracks {
+		at, err := td.albumTrack(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := td.albumTemplate().Render(at); got != want[i].path {
+			t.Errorf("track %v: got %q, want %q", i, got, want[i].path)
+		}
+
+		tags := td.flacTags(at)
+		if got := tags.Get("TRACKTOTAL"); len(got) != 1 || got[0] != want[i].total {
+			t.Errorf("track %v: got TRACKTOTAL %v, want %v", i, got, want[i].total)
+		}
+		if got := tags.Get("DISCTOTAL"); len(got) != 1 || got[0] != "2" {
+			t.Errorf("track %v: got DISCTOTAL %v, want 2", i, got)
+		}
+	}
+
+	// without disc folders the second disc's tracks get the suffixes
+	// DownloadAlbum would give them
+	td.AlbumTemplate = MustParseTemplate("{albumartist}/{album}/{artist} - {title}")
+	td.SuffixCollisions = true
+
+	at, err := td.albumTrack(tracks[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := td.albumTemplate().Render(at); got != "Band/Live/Band - Intro (2)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLibraryFile(t *testing.T) {
+	td, tracks := discAPI(t)
+
+	root, err := ioutil.TempDir("", "tidl-library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	td.Root = root
+
+	writeSyncTree(t, root, "Band/Live/CD1/Band - Intro.flac", "Band/Live/CD2/Band - Intro.m4a")
+
+	want := []string{"Band/Live/CD1/Band - Intro.flac", "", "", "Band/Live/CD2/Band - Intro.m4a", ""}
+	for i, tr := range tracks {
+		got := td.libraryFile(tr)
+		if got != "" {
+			got, _ = filepath.Rel(root, got)
+			got = filepath.ToSlash(got)
+		}
+
+		if got != want[i] {
+			t.Errorf("track %v: got %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestPlaylistLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("links need privileges")
+	}
+
+	for _, mode := range []PlaylistMode{PlaylistLibrary, PlaylistSymlink, PlaylistHardlink} {
+		td, tracks := discAPI(t)
+
+		root, err := ioutil.TempDir("", "tidl-library")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		td.Root = root
+		td.PlaylistMode = mode
+
+		writeSyncTree(t, root, "Band/Live/CD2/Band - Intro.flac")
+		target := filepath.Join(root, "Band/Live/CD2/Band - Intro.flac")
+
+		p := Playlist{ID: "p", Title: "Mine", NumberOfTracks: 1}
+		tmpl := td.playlistTemplate()
+		tr := td.playlistTrack(p, 1, tracks[3])
+
+		got, err := td.playlistLink(tmpl, tr, tracks[3])
+		if err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+
+		link := tr.GetPath(root, tmpl) + ".flac"
+		info, lerr := os.Lstat(link)
+
+		switch mode {
+		case PlaylistLibrary:
+			if got != target || lerr == nil {
+				t.Errorf("library: got %q, link %v", got, lerr)
+			}
+		case PlaylistSymlink:
+			dest, _ := os.Readlink(link)
+			if got != link || lerr != nil || info.Mode()&os.ModeSymlink == 0 || filepath.IsAbs(dest) {
+				t.Errorf("symlink: got %q pointing at %q, %v", got, dest, lerr)
+			}
+		case PlaylistHardlink:
+			same := false
+			if tinfo, err := os.Stat(target); err == nil && lerr == nil {
+				same = os.SameFile(info, tinfo)
+			}
+			if got != link || !same {
+				t.Errorf("hardlink: got %q, same file %v", got, same)
+			}
+		}
+
+		if data, err := ioutil.ReadFile(got); err != nil || string(data) != "Band/Live/CD2/Band - Intro.flac" {
+			t.Errorf("%v: reads %q, %v", mode, data, err)
+		}
+	}
+}
+
+func TestParsePlaylistMode(t *testing.T) {
+	tests := map[string]PlaylistMode{
+		"":         PlaylistCopy,
+		"copy":     PlaylistCopy,
+		"Reuse":    PlaylistReuse,
+		"none":     PlaylistLibrary,
+		"link":     PlaylistSymlink,
+		"hardlink": PlaylistHardlink,
+	}
+
+	for in, want := range tests {
+		if got, err := ParsePlaylistMode(in); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	if _, err := ParsePlaylistMode("bogus"); err == nil {
+		t.Error("bogus parsed")
+	}
+}
@@ -0,0 +1,207 @@
+package tidl
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RefType is the kind of entity a Ref points at
+type RefType string
+
+const (
+	// RefUnknown is a bare numeric id without a type prefix
+	RefUnknown  RefType = ""
+	RefAlbum    RefType = "album"
+	RefTrack    RefType = "track"
+	RefArtist   RefType = "artist"
+	RefPlaylist RefType = "playlist"
+	RefMix      RefType = "mix"
+	RefVideo    RefType = "video"
+)
+
+// Ref is a typed reference to a Tidal entity
+type Ref struct {
+	Type RefType
+	ID   string
+}
+
+func (r Ref) String() string {
+	if r.Type == RefUnknown {
+		return r.ID
+	}
+
+	return string(r.Type) + ":" + r.ID
+}
+
+var (
+	numericID  = regexp.MustCompile(`^[0-9]+$`)
+	uuidID     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	mixID      = regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+	tidalHosts = map[string]bool{
+		"tidal.com":         true,
+		"www.tidal.com":     true,
+		"listen.tidal.com":  true,
+		"desktop.tidal.com": true,
+		"embed.tidal.com":   true,
+	}
+)
+
+// share short links only say what they point at after a redirect
+const shortLinkHost = "link.tidal.com"
+
+// ErrInvalidRef is returned when a string can't be parsed into a Ref
+var ErrInvalidRef = errors.New("invalid tidal reference")
+
+// ParseRef parses a Tidal url, uri, share link or prefixed id into a Ref.
+//
+// Accepted forms include:
+//
+//	https://tidal.com/browse/album/123
+//	https://listen.tidal.com/album/123/track/456
+//	https://tidal.com/track/456/u
+//	tidal://playlist/<uuid>
+//	album:123, tidal:track:456
+//	<uuid> (playlist)
+//	123 (RefUnknown, the caller has to work out what it is)
+func ParseRef(s string) (Ref, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Ref{}, ErrInvalidRef
+	}
+
+	lower := strings.ToLower(s)
+
+	switch {
+	case strings.HasPrefix(lower, "tidal://"):
+		return parseRefPath(s[len("tidal://"):])
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return parseRefURL(s)
+	case strings.HasPrefix(lower, "tidal:"):
+		return parseRefPrefixed(s[len("tidal:"):])
+	}
+
+	if strings.HasPrefix(lower, shortLinkHost+"/") {
+		return parseRefURL("https://" + s)
+	}
+
+	for host := range tidalHosts {
+		if strings.HasPrefix(lower, host+"/") {
+			return parseRefURL("https://" + s)
+		}
+	}
+
+	if strings.Contains(s, ":") {
+		return parseRefPrefixed(s)
+	}
+
+	switch {
+	case numericID.MatchString(s):
+		return Ref{Type: RefUnknown, ID: s}, nil
+	case uuidID.MatchString(s):
+		return Ref{Type: RefPlaylist, ID: strings.ToLower(s)}, nil
+	}
+
+	return Ref{}, fmt.Errorf("%w: %q", ErrInvalidRef, s)
+}
+
+func parseRefURL(s string) (Ref, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Ref{}, fmt.Errorf("%w: %v", ErrInvalidRef, err)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == shortLinkHost {
+		return Ref{}, fmt.Errorf("%w: short links can't be resolved, open %q and use the url it redirects to", ErrInvalidRef, s)
+	}
+
+	if !tidalHosts[host] {
+		return Ref{}, fmt.Errorf("%w: not a tidal url: %q", ErrInvalidRef, s)
+	}
+
+	return parseRefPath(u.Path)
+}
+
+// parseRefPath walks the path segments looking for "<type>/<id>" pairs, the
+// last pair wins so album/1/track/2 is a track
+func parseRefPath(p string) (Ref, error) {
+	p = strings.SplitN(p, "?", 2)[0]
+	p = strings.SplitN(p, "#", 2)[0]
+
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	var ref Ref
+	for i := 0; i < len(segments)-1; i++ {
+		typ, ok := refTypeOf(segments[i])
+		if !ok {
+			continue
+		}
+
+		r, err := newRef(typ, segments[i+1])
+		if err != nil {
+			return Ref{}, err
+		}
+
+		ref = r
+		i++
+	}
+
+	if ref.ID == "" {
+		return Ref{}, fmt.Errorf("%w: %q", ErrInvalidRef, p)
+	}
+
+	return ref, nil
+}
+
+func parseRefPrefixed(s string) (Ref, error) {
+	parts := strings.SplitN(s, ":", 2)
+	typ, ok := refTypeOf(parts[0])
+	if !ok || len(parts) != 2 {
+		return Ref{}, fmt.Errorf("%w: unknown type in %q", ErrInvalidRef, s)
+	}
+
+	return newRef(typ, parts[1])
+}
+
+func refTypeOf(s string) (RefType, bool) {
+	switch strings.ToLower(s) {
+	case "album", "albums":
+		return RefAlbum, true
+	case "track", "tracks":
+		return RefTrack, true
+	case "artist", "artists":
+		return RefArtist, true
+	case "playlist", "playlists":
+		return RefPlaylist, true
+	case "mix", "mixes":
+		return RefMix, true
+	case "video", "videos":
+		return RefVideo, true
+	}
+
+	return RefUnknown, false
+}
+
+func newRef(typ RefType, id string) (Ref, error) {
+	id = strings.TrimSpace(id)
+
+	var ok bool
+	switch typ {
+	case RefPlaylist:
+		ok = uuidID.MatchString(id)
+		id = strings.ToLower(id)
+	case RefMix:
+		ok = mixID.MatchString(id)
+	default:
+		ok = numericID.MatchString(id)
+	}
+
+	if !ok {
+		return Ref{}, fmt.Errorf("%w: bad %s id %q", ErrInvalidRef, typ, id)
+	}
+
+	return Ref{Type: typ, ID: id}, nil
+}
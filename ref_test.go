@@ -0,0 +1,96 @@
+package tidl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRef(t *testing.T) {
+	const uuid = "0b5df380-47d3-48fe-ae66-8f0dba90b1ee"
+
+	tests := []struct {
+		in   string
+		want Ref
+	}{
+		// tidal:// uris
+		{"tidal://album/123", Ref{RefAlbum, "123"}},
+		{"tidal://track/456", Ref{RefTrack, "456"}},
+		{"tidal://playlist/" + uuid, Ref{RefPlaylist, uuid}},
+		{"TIDAL://artist/7", Ref{RefArtist, "7"}},
+
+		// share links
+		{"https://tidal.com/browse/album/123", Ref{RefAlbum, "123"}},
+		{"https://tidal.com/browse/track/456?u", Ref{RefTrack, "456"}},
+		{"https://tidal.com/track/456/u", Ref{RefTrack, "456"}},
+		{"https://listen.tidal.com/album/123/track/456", Ref{RefTrack, "456"}},
+		{"https://listen.tidal.com/artist/7#top", Ref{RefArtist, "7"}},
+		{"https://tidal.com/browse/playlist/" + uuid, Ref{RefPlaylist, uuid}},
+		{"https://tidal.com/browse/mix/0011a8a5fb2d4a2bd4a7f2a2ef1a22", Ref{RefMix, "0011a8a5fb2d4a2bd4a7f2a2ef1a22"}},
+		{"https://tidal.com/browse/video/89", Ref{RefVideo, "89"}},
+		{"http://www.tidal.com/album/1", Ref{RefAlbum, "1"}},
+		{"https://desktop.tidal.com/album/1", Ref{RefAlbum, "1"}},
+		{"https://embed.tidal.com/tracks/2", Ref{RefTrack, "2"}},
+		{"tidal.com/browse/album/123", Ref{RefAlbum, "123"}},
+
+		// type: prefixes
+		{"album:123", Ref{RefAlbum, "123"}},
+		{"tidal:track:456", Ref{RefTrack, "456"}},
+		{"Artist:7", Ref{RefArtist, "7"}},
+		{"playlist:" + uuid, Ref{RefPlaylist, uuid}},
+		{"mix:abc123", Ref{RefMix, "abc123"}},
+
+		// bare ids
+		{"123", Ref{RefUnknown, "123"}},
+		{"  123\n", Ref{RefUnknown, "123"}},
+		{"0B5DF380-47D3-48FE-AE66-8F0DBA90B1EE", Ref{RefPlaylist, uuid}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRef(tt.in)
+		if err != nil {
+			t.Errorf("ParseRef(%q): %v", tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("ParseRef(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseRefInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"   ",
+		"https://example.com/album/123",
+		"https://tidal.com.evil.example/album/123",
+		"https://open.spotify.com/album/123",
+		"https://link.tidal.com/AbCdE",
+		"link.tidal.com/AbCdE",
+		"https://tidal.com/browse",
+		"https://tidal.com/album/abc",
+		"tidal://playlist/123",
+		"song:123",
+		"album:",
+		"not an id",
+	}
+
+	for _, in := range tests {
+		if ref, err := ParseRef(in); !errors.Is(err, ErrInvalidRef) {
+			t.Errorf("ParseRef(%q) = %#v, %v, want ErrInvalidRef", in, ref, err)
+		}
+	}
+}
+
+func TestRefString(t *testing.T) {
+	for _, s := range []string{"album:1", "track:2", "123"} {
+		ref, err := ParseRef(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ref.String() != s {
+			t.Errorf("%q round tripped to %q", s, ref.String())
+		}
+	}
+}
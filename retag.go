@@ -0,0 +1,248 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac"
+)
+
+// ErrUnidentified is returned when retag can't work out which track a file is
+var ErrUnidentified = errors.New("can't identify track")
+
+// Retag refetches the metadata and art of a downloaded FLAC or MP4 file and
+// rewrites its tags and pictures without touching the audio. With dryRun
+// nothing is written. It returns the tags before and after, MP4 atoms are
+// listed under their vorbis comment names.
+func (t *Tidal) Retag(path string, dryRun bool) (Tags, Tags, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return t.retagFlac(path, dryRun)
+	case ".m4a", ".mp4":
+		return t.retagMP4(path, dryRun)
+	}
+
+	return nil, nil, fmt.Errorf("can't retag %v files", filepath.Ext(path))
+}
+
+func (t *Tidal) retagFlac(path string, dryRun bool) (Tags, Tags, error) {
+	head, err := readFlacHead(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before := append(Tags{}, flacComment(head).Tags...)
+
+	tr, err := t.identify(path, before)
+	if err != nil {
+		return before, nil, err
+	}
+
+	if t.Lyrics {
+		tr.lyrics, _ = t.GetLyrics(tr.ID.String())
+	}
+
+	tr.Album = t.withPictures(tr.Album)
+	after := t.TagMerge.Merge(before, t.flacTags(tr))
+
+	if dryRun || len(DiffTags(before, after)) == 0 {
+		return before, after, nil
+	}
+
+	err = editFlac(path, func(stream *flac.Stream) {
+		flacComment(stream).Tags = after
+		setPictures(stream, tr.Album.pictures)
+	})
+
+	return before, after, err
+}
+
+// retagMP4 rewrites the ilst atoms we write on download. Like on download,
+// atoms we don't write are always kept, so only MergeKeep makes a difference.
+func (t *Tidal) retagMP4(path string, dryRun bool) (Tags, Tags, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	have, err := readMP4Items(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before := mp4Tags(have)
+
+	tr, err := t.identify(path, before)
+	if err != nil {
+		return before, nil, err
+	}
+
+	if t.Lyrics {
+		tr.lyrics, _ = t.GetLyrics(tr.ID.String())
+	}
+
+	tr.Album = t.withPictures(tr.Album)
+
+	var items []mp4Item
+	for _, item := range t.mp4Items(tr) {
+		if t.TagMerge == MergeKeep && containsMP4Key(have, item.Key) {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	data, err = tagMP4(data, items)
+	if err != nil {
+		return before, nil, err
+	}
+
+	now, err := readMP4Items(data)
+	if err != nil {
+		return before, nil, err
+	}
+
+	after := mp4Tags(now)
+	if dryRun || len(DiffTags(before, after)) == 0 {
+		return before, after, nil
+	}
+
+	return before, after, editMP4(path, items)
+}
+
+func containsMP4Key(items []mp4Item, key string) bool {
+	for _, item := range items {
+		if item.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// identify works out the track of a downloaded file, from its TIDAL_TRACK_ID
+// tag or from the meta.json written next to it plus its track and disc
+// numbers
+func (t *Tidal) identify(path string, tags Tags) (Track, error) {
+	number := func(key string, def int) int {
+		values := tags.Get(key)
+		if len(values) == 0 {
+			return def
+		}
+
+		// some taggers write 3/12
+		n, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(values[0], "/", 2)[0]))
+		if err != nil {
+			return def
+		}
+		return n
+	}
+
+	var tr Track
+	if ids := tags.Get("TIDAL_TRACK_ID"); len(ids) > 0 {
+		var err error
+		if tr, err = t.GetTrack(ids[0]); err != nil {
+			return tr, err
+		}
+	}
+
+	albumID, p := readIndex(filepath.Dir(path))
+
+	switch {
+	case p != nil:
+		n := number("TRACKNUMBER", 0)
+		if tr.ID == "" {
+			tracks, err := t.GetPlaylistTracks(p.ID)
+			if err != nil {
+				return tr, err
+			}
+
+			if n < 1 || n > len(tracks) {
+				return tr, ErrUnidentified
+			}
+			tr = tracks[n-1]
+		}
+
+		// symlinks and hardlinks share the album copy, which keeps its album
+		// tags like on sync
+		if linksLibrary(path) {
+			return t.albumTrack(tr)
+		}
+
+		return t.playlistTrack(*p, n, tr), nil
+	case tr.ID == "" && albumID != "":
+		tracks, err := t.GetAlbumTracks(albumID)
+		if err != nil {
+			return tr, err
+		}
+
+		disc, n := strconv.Itoa(number("DISCNUMBER", 1)), strconv.Itoa(number("TRACKNUMBER", 0))
+		for _, other := range tracks {
+			if other.disc() == disc && other.TrackNumber.String() == n {
+				tr = other
+			}
+		}
+	}
+
+	if tr.ID == "" {
+		return tr, ErrUnidentified
+	}
+
+	return t.albumTrack(tr)
+}
+
+// linksLibrary reports whether a file in a playlist folder is a symlink or
+// hardlink to a file in the album library rather than its own copy
+func linksLibrary(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeSymlink != 0 || hardLinked(path)
+}
+
+// readIndex reads the meta.json next to a track, or one folder up for disc
+// folders. It returns the album id or the playlist the track was downloaded
+// as part of.
+func readIndex(dir string) (string, *Playlist) {
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		data, err := ioutil.ReadFile(filepath.Join(d, "meta.json"))
+		if err != nil {
+			continue
+		}
+
+		// albums have numeric ids, playlists, mixes and top tracks strings
+		var index struct {
+			ID             json.RawMessage
+			Title          string
+			Snapshot       string
+			NumberOfTracks int
+		}
+
+		if err := json.Unmarshal(data, &index); err != nil {
+			return "", nil
+		}
+
+		if !bytes.HasPrefix(index.ID, []byte(`"`)) {
+			return string(index.ID), nil
+		}
+
+		p := &Playlist{
+			Title:          index.Title,
+			Snapshot:       index.Snapshot,
+			NumberOfTracks: index.NumberOfTracks,
+		}
+		json.Unmarshal(index.ID, &p.ID)
+
+		return "", p
+	}
+
+	return "", nil
+}
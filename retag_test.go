@@ -0,0 +1,174 @@
+package tidl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retagAPI serves the second disc's intro of discAlbum by id
+func retagAPI(t *testing.T) *Tidal {
+	al, tracks := discAlbum()
+
+	tr := tracks[3]
+	tr.Album = Album{ID: al.ID}
+
+	td := testAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/tracks/13":
+			json.NewEncoder(w).Encode(tr)
+		case r.URL.Path == "/v1/albums/1/tracks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": tracks})
+		case strings.HasSuffix(r.URL.Path, "/credits"):
+			w.Write([]byte("[]"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	td.albumMap[al.ID.String()] = al
+
+	return td
+}
+
+func TestRetagPlaylistLinks(t *testing.T) {
+	td := retagAPI(t)
+
+	root, err := ioutil.TempDir("", "tidl-retag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	lib := filepath.Join(root, "Band", "Live", "CD2")
+	list := filepath.Join(root, "Mine")
+	os.MkdirAll(lib, os.ModePerm)
+	os.MkdirAll(list, os.ModePerm)
+
+	index := `{"ID":"p","Title":"Mine","NumberOfTracks":2}`
+	if err := ioutil.WriteFile(filepath.Join(list, "meta.json"), []byte(index), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	flacFile := func(path, n string) {
+		var tags Tags
+		tags.Add("TITLE", "Intro")
+		tags.Add("TRACKNUMBER", n)
+		tags.Add("TIDAL_TRACK_ID", "13")
+
+		rng := rand.New(rand.NewSource(4))
+		writeTestFlac(t, path, 44100, 16, testTrack{samples: [][]int64{noiseSignal(rng, 2000, 16)}, tags: tags})
+	}
+
+	album := func(path string) string {
+		tags, err := readFileTags(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(tags.Get("ALBUM"))
+	}
+
+	target := filepath.Join(lib, "Band - Intro.flac")
+	flacFile(target, "1")
+	if _, _, err := td.Retag(target, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a playlist copy of its own gets the playlist tags
+	copied := filepath.Join(list, "02 Band - Intro.flac")
+	flacFile(copied, "2")
+	if _, _, err := td.Retag(copied, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := album(copied); got != "[Mine]" {
+		t.Errorf("copy: got ALBUM %v", got)
+	}
+
+	// links are the album copy, which already has its tags, so nothing is
+	// written
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(target, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]func(string, string) error{
+		"symlink":  os.Symlink,
+		"hardlink": os.Link,
+	}
+
+	for name, link := range links {
+		path := filepath.Join(list, name+".flac")
+		if err := link(target, path); err != nil {
+			t.Logf("%v: %v", name, err)
+			continue
+		}
+
+		before, after, err := td.Retag(path, false)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if diff := DiffTags(before, after); len(diff) != 0 {
+			t.Errorf("%v: got diff %v", name, diff)
+		}
+
+		if got := album(target); got != "[Live]" {
+			t.Errorf("%v: got ALBUM %v on the album copy", name, got)
+		}
+		if info, err := os.Stat(target); err != nil || !info.ModTime().Equal(old) {
+			t.Errorf("%v: album copy written without changes", name)
+		}
+	}
+}
+
+func TestRetagMP4Symlink(t *testing.T) {
+	td := retagAPI(t)
+
+	root, err := ioutil.TempDir("", "tidl-retag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	udta := makeBox("udta", fullBox("meta",
+		fullBox("hdlr", u32(0), []byte("mdirappl"), make([]byte, 9)),
+		makeBox("ilst", renderIlstAtom(mp4FreeformKey("TIDAL_TRACK_ID"), []mp4Item{mp4Text("", "13")}))))
+
+	target := filepath.Join(root, "Band - Intro.m4a")
+	if err := ioutil.WriteFile(target, plainMP4("stco", udta), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	list := filepath.Join(root, "Mine")
+	os.MkdirAll(list, os.ModePerm)
+	if err := ioutil.WriteFile(filepath.Join(list, "meta.json"), []byte(`{"ID":"p","Title":"Mine"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(list, "01 Band - Intro.m4a")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+
+	if _, _, err := td.Retag(link, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link replaced: %v", err)
+	}
+
+	tags, err := readFileTags(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(tags.Get("ALBUM")); got != "[Live]" {
+		t.Errorf("got ALBUM %v", got)
+	}
+	checkChunks(t, mustReadFile(t, target), len(mp4Chunks))
+}
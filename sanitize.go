@@ -0,0 +1,220 @@
+package tidl
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SanitizeProfile selects how strict file names are cleaned up
+type SanitizeProfile int
+
+const (
+	// SanitizePOSIX only swaps "/" and control characters
+	SanitizePOSIX SanitizeProfile = iota
+	// SanitizeWindows also swaps the characters NTFS/SMB reject for unicode
+	// look-alikes, strips trailing dots and spaces and avoids reserved names
+	SanitizeWindows
+	// SanitizeFAT32 is like SanitizeWindows but uses plain replacements,
+	// since players with FAT32 storage rarely have the fonts for look-alikes
+	SanitizeFAT32
+	// SanitizeASCII is SanitizeFAT32 limited to printable ascii, accents are
+	// stripped and anything else is replaced
+	SanitizeASCII
+)
+
+// DefaultMaxBytes is the per component limit most filesystems share
+const DefaultMaxBytes = 255
+
+// MinMaxBytes is the smallest MaxBytes that leaves room for an extension, a
+// collision suffix and some of the name next to the hash truncate adds
+const MinMaxBytes = 48
+
+// hashSuffixLen is the length of the "~xxxxxxxx" truncate appends
+const hashSuffixLen = 9
+
+// ParseSanitizeProfile parses "posix", "windows", "fat32" or "ascii"
+func ParseSanitizeProfile(s string) (SanitizeProfile, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "posix":
+		return SanitizePOSIX, nil
+	case "windows", "smb", "ntfs":
+		return SanitizeWindows, nil
+	case "fat32", "fat", "vfat":
+		return SanitizeFAT32, nil
+	case "ascii":
+		return SanitizeASCII, nil
+	}
+
+	return SanitizePOSIX, fmt.Errorf("unknown sanitize profile: %q", s)
+}
+
+// Sanitizer cleans up single path components. The zero value is the POSIX
+// profile with DefaultMaxBytes.
+type Sanitizer struct {
+	Profile SanitizeProfile
+	// MaxBytes caps the utf-8 length of a component, DefaultMaxBytes when 0
+	MaxBytes int
+}
+
+// look-alikes for characters windows won't have in a file name
+var windowsReplacer = strings.NewReplacer(
+	"/", "∕", // division slash
+	"\\", "⧵", // reverse solidus operator
+	":", "：",
+	"*", "＊",
+	"?", "？",
+	`"`, "＂",
+	"<", "＜",
+	">", "＞",
+	"|", "｜",
+)
+
+var fatReplacer = strings.NewReplacer(
+	"/", "-",
+	"\\", "-",
+	":", " -",
+	"*", "_",
+	"?", "",
+	`"`, "'",
+	"<", "(",
+	">", ")",
+	"|", "-",
+)
+
+// transliterations for letters that don't decompose into ascii + marks
+var asciiReplacer = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE",
+	"ø", "o", "Ø", "O", "ł", "l", "Ł", "L", "đ", "d", "Đ", "D",
+	"þ", "th", "Þ", "Th", "ð", "d", "Ð", "D", "ı", "i",
+	"‘", "'", "’", "'", "“", "'", "”", "'",
+	"‐", "-", "‑", "-", "‒", "-", "–", "-", "—", "-",
+	"…", "...", "×", "x", "∕", "-",
+)
+
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Component sanitizes a single path component
+func (s Sanitizer) Component(name string) string {
+	return s.component(name, 0)
+}
+
+// component sanitizes name, leaving reserve bytes of the limit free for an
+// extension
+func (s Sanitizer) component(name string, reserve int) string {
+	name = norm.NFC.String(name)
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, name)
+
+	switch s.Profile {
+	case SanitizePOSIX:
+		name = strings.Replace(name, "/", "∕", -1)
+	case SanitizeWindows:
+		name = windowsReplacer.Replace(name)
+	case SanitizeFAT32:
+		name = fatReplacer.Replace(name)
+	case SanitizeASCII:
+		name = fatReplacer.Replace(toASCII(name))
+	}
+
+	name = strings.TrimSpace(name)
+
+	if s.Profile != SanitizePOSIX {
+		name = strings.TrimRight(name, ". ")
+
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if windowsReserved[strings.TrimSpace(base)] {
+			name = "_" + name
+		}
+	}
+
+	max := s.MaxBytes
+	if max <= 0 {
+		max = DefaultMaxBytes
+	}
+
+	// a limit below what's reserved would leave nothing of the name, keep at
+	// least a character and the hash rather than overshoot by less
+	limit := max - reserve
+	if limit <= hashSuffixLen {
+		limit = hashSuffixLen + 1
+	}
+
+	name = truncate(name, limit)
+
+	if name == "" || name == "." || name == ".." {
+		name = strings.Repeat("_", len(name)+1)
+	}
+
+	return name
+}
+
+// toASCII strips accents and replaces anything left outside printable ascii
+func toASCII(s string) string {
+	s = asciiReplacer.Replace(norm.NFKD.String(s))
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r < 0x80:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
+
+// truncate cuts s to at most max bytes on a character boundary. Truncated
+// names get a short hash of the full name appended, so the result is stable
+// between runs and names sharing a long prefix stay apart.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	suffix := fmt.Sprintf("~%08x", crc32.ChecksumIEEE([]byte(s)))
+	switch {
+	case max <= 0:
+		return ""
+	case max <= len(suffix):
+		return suffix[len(suffix)-max:]
+	}
+
+	cut := max - len(suffix)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	// don't leave a base character without its combining marks
+	for cut > 0 {
+		r, _ := utf8.DecodeRuneInString(s[cut:])
+		if !unicode.Is(unicode.Mn, r) {
+			break
+		}
+
+		cut--
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+	}
+
+	return strings.TrimRight(s[:cut], ". ") + suffix
+}
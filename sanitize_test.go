@@ -0,0 +1,131 @@
+package tidl
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizerComponent(t *testing.T) {
+	tests := []struct {
+		profile SanitizeProfile
+		in      string
+		want    string
+	}{
+		{SanitizePOSIX, "AC/DC", "AC∕DC"},
+		{SanitizePOSIX, "What?: A *Song*", "What?: A *Song*"},
+		{SanitizePOSIX, "tab\there", "tab_here"},
+		{SanitizePOSIX, "  padded  ", "padded"},
+		{SanitizePOSIX, "..", "___"},
+		{SanitizePOSIX, "", "_"},
+		{SanitizePOSIX, "Café", "Café"},
+		{SanitizeWindows, "What?: A *Song*", "What？： A ＊Song＊"},
+		{SanitizeWindows, "Trailing dots...", "Trailing dots"},
+		{SanitizeWindows, "con", "_con"},
+		{SanitizeWindows, "Aux.txt", "_Aux.txt"},
+		{SanitizeWindows, "Console", "Console"},
+		{SanitizeFAT32, `Re: "Quoted" <a|b>`, `Re - 'Quoted' (a-b)`},
+		{SanitizeFAT32, "AC/DC", "AC-DC"},
+		{SanitizeASCII, "Björk – Jóga", "Bjork - Joga"},
+		{SanitizeASCII, "Straße Œuvre", "Strasse OEuvre"},
+		{SanitizeASCII, "東京", "__"},
+	}
+
+	for _, tt := range tests {
+		if got := (Sanitizer{Profile: tt.profile}).Component(tt.in); got != tt.want {
+			t.Errorf("%v: Component(%q) = %q, want %q", tt.profile, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSanitizeProfile(t *testing.T) {
+	tests := map[string]SanitizeProfile{
+		"":        SanitizePOSIX,
+		"posix":   SanitizePOSIX,
+		"Windows": SanitizeWindows,
+		"smb":     SanitizeWindows,
+		"vfat":    SanitizeFAT32,
+		" ascii ": SanitizeASCII,
+	}
+
+	for in, want := range tests {
+		if got, err := ParseSanitizeProfile(in); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	if _, err := ParseSanitizeProfile("bogus"); err == nil {
+		t.Error("bogus parsed")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	long := strings.Repeat("ab", 100)
+
+	tests := []struct {
+		in  string
+		max int
+	}{
+		{"short", 255},
+		{long, 50},
+		{long, hashSuffixLen + 1},
+		{long, hashSuffixLen},
+		{long, 3},
+		{long, 0},
+		{long, -5},
+		// multi-byte characters and combining marks are never split
+		{strings.Repeat("日本", 30), 40},
+		{strings.Repeat("é́", 30), 40},
+	}
+
+	for _, tt := range tests {
+		got := truncate(tt.in, tt.max)
+
+		want := tt.max
+		if want < 0 {
+			want = 0
+		}
+		if len(got) > want && len(tt.in) > want {
+			t.Errorf("truncate(%.10q, %v) is %v bytes", tt.in, tt.max, len(got))
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%.10q, %v) = %q isn't valid utf-8", tt.in, tt.max, got)
+		}
+	}
+
+	marked := truncate(strings.Repeat("é\u0301", 30), 40)
+	if kept := marked[:strings.LastIndex(marked, "~")]; !strings.HasSuffix(kept, "\u0301") {
+		t.Errorf("%q lost a combining mark", marked)
+	}
+
+	if truncate(long, 50) != truncate(long, 50) {
+		t.Error("truncate isn't stable")
+	}
+	if truncate(long+"x", 50) == truncate(long+"y", 50) {
+		t.Error("names sharing a prefix collide")
+	}
+}
+
+func TestSanitizerSmallMaxBytes(t *testing.T) {
+	tr := Track{ID: "1", Title: strings.Repeat("Long Title ", 10), Artist: Artist{Name: "Band"}, pathSuffix: " (2)"}
+	tmpl := MustParseTemplate("{artist}/{title}")
+
+	for _, max := range []int{1, extensionReserve, extensionReserve + len(tr.pathSuffix), MinMaxBytes} {
+		s := Sanitizer{MaxBytes: max}
+		name := s.component(tr.Title, extensionReserve+len(tr.pathSuffix))
+		if name == "" {
+			t.Errorf("max %v: empty name", max)
+		}
+
+		got := tmpl.WithSanitizer(s).Render(tr)
+		if !strings.HasSuffix(got, " (2)") {
+			t.Errorf("max %v: rendered %q", max, got)
+		}
+	}
+
+	// at the CLI's minimum the name still fits with an extension
+	s := Sanitizer{MaxBytes: MinMaxBytes}
+	if name := s.component(tr.Title, extensionReserve+len(tr.pathSuffix)); len(name)+len(tr.pathSuffix)+len(".flac") > MinMaxBytes {
+		t.Errorf("%q doesn't leave room for an extension", name)
+	}
+}
@@ -0,0 +1,148 @@
+package tidl
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// DefaultSeekSpacing is the distance between seek points players are happy
+// with
+const DefaultSeekSpacing = 10 * time.Second
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteSeekTable adds a SEEKTABLE with a point every spacing to a FLAC file
+// that doesn't have one. It reports whether a table was added.
+func WriteSeekTable(path string, spacing time.Duration) (bool, error) {
+	head, err := readFlacHead(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, block := range head.Blocks {
+		if _, ok := block.Body.(*meta.SeekTable); ok {
+			return false, nil
+		}
+	}
+
+	points, err := seekPoints(path, head.Info.SampleRate, spacing)
+	if err != nil || len(points) == 0 {
+		return false, err
+	}
+
+	err = editFlac(path, func(stream *flac.Stream) {
+		// players look for it early, put it right after STREAMINFO
+		block := &meta.Block{
+			Header: meta.Header{Type: meta.TypeSeekTable},
+			Body:   &meta.SeekTable{Points: points},
+		}
+		stream.Blocks = append([]*meta.Block{block}, stream.Blocks...)
+	})
+
+	return err == nil, err
+}
+
+// seekPoints walks the frames of a FLAC file and picks the frame holding
+// every spacing'th sample
+func seekPoints(path string, sampleRate uint32, spacing time.Duration) ([]meta.SeekPoint, error) {
+	if spacing <= 0 {
+		spacing = DefaultSeekSpacing
+	}
+
+	step := uint64(spacing.Seconds() * float64(sampleRate))
+	if step == 0 {
+		step = 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	start, err := flacMetadataSize(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// frames only read what they need, so the count is exactly where each
+	// one starts
+	r := &countingReader{r: bufio.NewReader(f)}
+
+	var points []meta.SeekPoint
+	var sample, next uint64
+	for {
+		offset := r.n
+
+		fr, err := frame.New(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		n := uint64(fr.BlockSize)
+		if sample+n > next {
+			points = append(points, meta.SeekPoint{
+				SampleNum: sample,
+				Offset:    uint64(offset),
+				NSamples:  uint16(n),
+			})
+
+			for next < sample+n {
+				next += step
+			}
+		}
+
+		// the subframes have to be decoded to find where the frame ends
+		if err := fr.Parse(); err != nil {
+			return nil, err
+		}
+		sample += n
+	}
+
+	return points, nil
+}
+
+// WriteSeekTableTree adds seek tables to every FLAC file under root that
+// lacks one, done is called for each file a table was added to or failed for
+func WriteSeekTableTree(root string, spacing time.Duration, done func(path string, err error)) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".flac") {
+			return nil
+		}
+
+		added, err := WriteSeekTable(path, spacing)
+		if added || err != nil {
+			done(path, err)
+		}
+
+		return nil
+	})
+}
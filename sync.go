@@ -0,0 +1,497 @@
+package tidl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sync keeps what the playlist looked like last time next to meta.json, and
+// where each playlist's folder is in an index under the library root
+const (
+	syncSnapshotFile  = ".tidl-sync.json"
+	syncIndexFile     = ".tidl-sync-index.json"
+	syncChangelogFile = "changelog.txt"
+	syncArchiveDir    = ".archive"
+)
+
+type syncSnapshot struct {
+	ID     string
+	Title  string
+	Synced time.Time
+	Tracks []syncTrack
+}
+
+type syncTrack struct {
+	ID       string
+	Position int
+	Artist   string
+	Title    string
+	// Path is relative to the playlist folder, "" when the track isn't a
+	// file in there, like library entries or failed downloads
+	Path string `json:",omitempty"`
+}
+
+func (st syncTrack) display() string {
+	return st.Artist + " - " + st.Title
+}
+
+type syncMove struct {
+	from, to string
+}
+
+// SyncPlaylist brings a downloaded playlist in line with the remote one.
+// Tracks dropped since the last sync are deleted, or moved into .archive
+// with archive set, moved tracks are renamed and renumbered and new ones
+// downloaded. A renamed playlist's folder follows it. It returns the
+// changes, which are also appended to the changelog in the playlist folder.
+func (t *Tidal) SyncPlaylist(p Playlist, archive bool) ([]string, error) {
+	if p.Duration == 0 {
+		return nil, errors.New("playlist unavailable")
+	}
+
+	if len(p.Tracks) == 0 {
+		var err error
+		p.Tracks, err = t.GetPlaylistTracks(p.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// without tracks there's no folder to work out, and deleting everything
+	// is more likely an api hiccup than what the user wants
+	if len(p.Tracks) == 0 {
+		return nil, errors.New("playlist is empty")
+	}
+
+	art, err := p.GetArt()
+	if err != nil {
+		return nil, err
+	}
+	p.artBody = art
+
+	tmpl := t.playlistTemplate()
+	tracks, sources := t.playlistTracks(p)
+
+	// refuse before anything is moved or deleted, the paths below need the
+	// suffixes and downloadPlaylistTracks reports them
+	if _, err := t.checkPaths(tmpl, tracks); err != nil {
+		return nil, err
+	}
+
+	dir := t.collectionDir(tmpl, tracks)
+
+	// the folder is named after the playlist, so after a rename the old one
+	// is found through the index and moved
+	index, err := readSyncIndex(t.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	if rel, ok := index[p.ID]; ok {
+		moved, err := moveSyncDir(t.Root, filepath.Join(t.Root, rel), dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if moved {
+			to, _ := filepath.Rel(t.Root, dir)
+			changes = append(changes, fmt.Sprintf("moved %v to %v", rel, to))
+		}
+	}
+
+	old, err := readSyncSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if old.ID != "" && old.ID != p.ID {
+		return nil, fmt.Errorf("%v is already synced with playlist %v", dir, old.ID)
+	}
+
+	previous := make(map[string]syncTrack)
+	for _, st := range old.Tracks {
+		previous[st.ID] = st
+	}
+
+	current := make(map[string]bool)
+	for _, tr := range tracks {
+		current[tr.ID.String()] = true
+	}
+
+	if old.Title != "" && old.Title != p.Title {
+		changes = append(changes, fmt.Sprintf("renamed %q to %q", old.Title, p.Title))
+	}
+
+	for _, st := range old.Tracks {
+		if current[st.ID] {
+			continue
+		}
+
+		change := "- " + st.display()
+		if st.Path != "" {
+			if err := dropSyncFile(dir, st.Path, archive); err != nil {
+				change += fmt.Sprintf(" (%v)", err)
+			} else if archive {
+				change += " (archived)"
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	var moves []syncMove
+	for i, tr := range tracks {
+		st, ok := previous[tr.ID.String()]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ %d %v", i+1, tr.artistName()+" - "+tr.titleName()))
+			continue
+		}
+
+		if st.Position != i+1 {
+			changes = append(changes, fmt.Sprintf("~ %d -> %d %v", st.Position, i+1, st.display()))
+		}
+
+		// templates with {track} in them move the file too
+		if st.Path != "" {
+			from := filepath.Join(dir, st.Path)
+			to := tr.GetPath(t.Root, tmpl) + filepath.Ext(from)
+			if from != to {
+				moves = append(moves, syncMove{from, to})
+			}
+		}
+	}
+
+	if err := renameSyncFiles(moves); err != nil {
+		return changes, err
+	}
+
+	if err := t.downloadPlaylistTracks(tmpl, p, tracks, sources); err != nil {
+		return changes, err
+	}
+
+	next := syncSnapshot{ID: p.ID, Title: p.Title, Synced: time.Now()}
+	for i, tr := range tracks {
+		st := syncTrack{
+			ID:       tr.ID.String(),
+			Position: i + 1,
+			Artist:   tr.artistName(),
+			Title:    tr.titleName(),
+		}
+
+		if path := tr.findFile(t.Root, tmpl); path != "" {
+			if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				st.Path = rel
+			}
+
+			// hardlinks and symlinks share the album copy, which keeps its
+			// album numbering
+			if t.PlaylistMode == PlaylistCopy || t.PlaylistMode == PlaylistReuse {
+				if err := t.renumber(path, tr); err != nil {
+					changes = append(changes, fmt.Sprintf("! %v: %v", st.display(), err))
+				}
+			}
+		}
+
+		next.Tracks = append(next.Tracks, st)
+	}
+
+	if err := writeSyncSnapshot(dir, next); err != nil {
+		return changes, err
+	}
+
+	if rel, err := filepath.Rel(t.Root, dir); err == nil {
+		index[p.ID] = rel
+		if err := writeSyncIndex(t.Root, index); err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, appendChangelog(dir, next.Synced, changes)
+}
+
+// readSyncIndex returns the folders of synced playlists by id, relative to
+// root
+func readSyncIndex(root string) (map[string]string, error) {
+	index := make(map[string]string)
+
+	data, err := ioutil.ReadFile(filepath.Join(root, syncIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+func writeSyncIndex(root string, index map[string]string) error {
+	data, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(root, os.ModePerm)
+	return ioutil.WriteFile(filepath.Join(root, syncIndexFile), data, 0777)
+}
+
+// moveSyncDir moves a playlist folder from where it was synced last to where
+// it goes now. It does nothing when the old folder is gone, and refuses to
+// merge into a folder that already exists or to move the root itself.
+func moveSyncDir(root, from, to string) (bool, error) {
+	if from == to {
+		return false, nil
+	}
+
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	for _, dir := range []string{from, to} {
+		if rel, err := filepath.Rel(root, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return false, fmt.Errorf("can't move playlist folder %v to %v", from, to)
+		}
+	}
+
+	if _, err := os.Lstat(to); err == nil {
+		return false, fmt.Errorf("can't move playlist folder %v to %v, it already exists", from, to)
+	}
+
+	os.MkdirAll(filepath.Dir(to), os.ModePerm)
+	return true, os.Rename(from, to)
+}
+
+func readSyncSnapshot(dir string) (syncSnapshot, error) {
+	var snapshot syncSnapshot
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, syncSnapshotFile))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func writeSyncSnapshot(dir string, snapshot syncSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, syncSnapshotFile), data, 0777)
+}
+
+// appendChangelog adds a dated section to the changelog, runs without
+// changes aren't logged
+func appendChangelog(dir string, now time.Time, changes []string) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, syncChangelogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0777)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%v\n", now.Format("2006-01-02 15:04:05"))
+	for _, change := range changes {
+		fmt.Fprintf(&b, "\t%v\n", change)
+	}
+	b.WriteString("\n")
+
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncSidecars are the files that belong to a track and move with it
+func syncSidecars(path string) []string {
+	return []string{path, strings.TrimSuffix(path, filepath.Ext(path)) + ".lrc"}
+}
+
+// dropSyncFile deletes a track and its lyrics, or moves them into a dated
+// folder under .archive, keeping their path relative to the playlist folder
+func dropSyncFile(dir, rel string, archive bool) error {
+	path := filepath.Join(dir, rel)
+	if r, err := filepath.Rel(dir, path); err != nil || strings.HasPrefix(r, "..") {
+		return fmt.Errorf("%v is outside the playlist", rel)
+	}
+
+	archiveDir := filepath.Join(dir, syncArchiveDir, time.Now().Format("2006-01-02"))
+
+	for i, file := range syncSidecars(path) {
+		if _, err := os.Lstat(file); err != nil {
+			// the track itself going missing is worth knowing about
+			if i == 0 && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if !archive {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		to := filepath.Join(archiveDir, r)
+		os.MkdirAll(filepath.Dir(to), os.ModePerm)
+		if err := os.Rename(file, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameSyncFiles moves tracks to their new paths. Tracks can swap places so
+// everything goes to a temporary name first. If a rename fails, or a target
+// is taken by a file that isn't moving, everything is put back.
+func renameSyncFiles(moves []syncMove) error {
+	type step struct {
+		from, tmp, to string
+	}
+
+	var steps []step
+	done := 0
+
+	// undo the finished renames, then bring the temporary files back
+	restore := func(err error) error {
+		for _, s := range steps[:done] {
+			os.Rename(s.to, s.tmp)
+		}
+		for _, s := range steps {
+			os.Rename(s.tmp, s.from)
+		}
+		return err
+	}
+
+	for i, move := range moves {
+		targets := syncSidecars(move.to)
+		for j, from := range syncSidecars(move.from) {
+			if _, err := os.Lstat(from); err != nil {
+				continue
+			}
+
+			tmp := fmt.Sprintf("%v.sync-%d-%d", from, i, j)
+			if err := os.Rename(from, tmp); err != nil {
+				return restore(err)
+			}
+			steps = append(steps, step{from, tmp, targets[j]})
+		}
+	}
+
+	for _, s := range steps {
+		if _, err := os.Lstat(s.to); err == nil {
+			return restore(fmt.Errorf("can't move %v to %v, it already exists", filepath.Base(s.from), s.to))
+		}
+
+		os.MkdirAll(filepath.Dir(s.to), os.ModePerm)
+		if err := os.Rename(s.tmp, s.to); err != nil {
+			return restore(err)
+		}
+		done++
+	}
+
+	return nil
+}
+
+// renumber updates the album and track number tags of a playlist copy in
+// place when they're out of date
+func (t *Tidal) renumber(path string, tr Track) error {
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		want := t.flacTags(tr)
+		keys := []string{"ALBUM", "TRACKNUMBER", "TRACKTOTAL"}
+
+		head, err := readFlacHead(path)
+		if err != nil {
+			return err
+		}
+
+		have := Tags(flacComment(head).Tags)
+
+		stale := false
+		for _, key := range keys {
+			stale = stale || strings.Join(have.Get(key), "\x00") != strings.Join(want.Get(key), "\x00")
+		}
+
+		if !stale {
+			return nil
+		}
+
+		return editFlacTags(path, func(tags *Tags) {
+			for _, key := range keys {
+				tags.Set(key, want.Get(key)...)
+			}
+		})
+	case ".m4a", ".mp4":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		have, err := readMP4Items(data)
+		if err != nil {
+			return err
+		}
+
+		var items []mp4Item
+		stale := false
+		for _, item := range t.mp4Items(tr) {
+			if item.Key != mp4Album && item.Key != mp4Track {
+				continue
+			}
+
+			items = append(items, item)
+
+			found := false
+			for _, h := range have {
+				found = found || (h.Key == item.Key && bytes.Equal(h.Data, item.Data))
+			}
+			stale = stale || !found
+		}
+
+		if !stale {
+			return nil
+		}
+
+		data, err = tagMP4(data, items)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path+".part", data, 0777); err != nil {
+			return err
+		}
+
+		return os.Rename(path+".part", path)
+	}
+
+	return nil
+}
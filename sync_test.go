@@ -0,0 +1,167 @@
+package tidl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSyncTree creates files under dir with their own relative path as
+// content
+func writeSyncTree(t *testing.T, dir string, files ...string) {
+	t.Helper()
+
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := ioutil.WriteFile(path, []byte(file), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkSyncTree fails unless path holds the file originally written as want
+func checkSyncTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for path, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("%v: %v", path, err)
+		} else if string(got) != want {
+			t.Errorf("%v holds %q, want %q", path, got, want)
+		}
+	}
+}
+
+func syncTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tidl-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestRenameSyncFilesSwap(t *testing.T) {
+	dir := syncTempDir(t)
+	writeSyncTree(t, dir, "01 a.flac", "01 a.lrc", "02 b.flac")
+
+	err := renameSyncFiles([]syncMove{
+		{filepath.Join(dir, "01 a.flac"), filepath.Join(dir, "02 b.flac")},
+		{filepath.Join(dir, "02 b.flac"), filepath.Join(dir, "01 a.flac")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSyncTree(t, dir, map[string]string{
+		"02 b.flac": "01 a.flac",
+		"02 b.lrc":  "01 a.lrc",
+		"01 a.flac": "02 b.flac",
+	})
+
+	if _, err := os.Stat(filepath.Join(dir, "01 a.lrc")); !os.IsNotExist(err) {
+		t.Error("lyrics stayed behind")
+	}
+}
+
+func TestRenameSyncFilesRestore(t *testing.T) {
+	dir := syncTempDir(t)
+	writeSyncTree(t, dir, "01 a.flac", "02 b.flac", "02 b.lrc", "03 c.flac")
+
+	// b and a swap, but c isn't moving out of the way
+	err := renameSyncFiles([]syncMove{
+		{filepath.Join(dir, "02 b.flac"), filepath.Join(dir, "01 a.flac")},
+		{filepath.Join(dir, "01 a.flac"), filepath.Join(dir, "03 c.flac")},
+	})
+	if err == nil {
+		t.Fatal("moved a track onto another one")
+	}
+
+	checkSyncTree(t, dir, map[string]string{
+		"01 a.flac": "01 a.flac",
+		"02 b.flac": "02 b.flac",
+		"02 b.lrc":  "02 b.lrc",
+		"03 c.flac": "03 c.flac",
+	})
+
+	left, _ := filepath.Glob(filepath.Join(dir, "*.sync-*"))
+	if len(left) > 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
+
+func TestDropSyncFileArchive(t *testing.T) {
+	dir := syncTempDir(t)
+	writeSyncTree(t, dir, "CD1/01 a.flac", "CD1/01 a.lrc", "CD2/01 a.flac")
+
+	if err := dropSyncFile(dir, "CD1/01 a.flac", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same name from another folder doesn't clobber the first one
+	if err := dropSyncFile(dir, "CD2/01 a.flac", true); err != nil {
+		t.Fatal(err)
+	}
+
+	archived := filepath.Join(syncArchiveDir, time.Now().Format("2006-01-02"))
+	checkSyncTree(t, dir, map[string]string{
+		filepath.Join(archived, "CD1/01 a.flac"): "CD1/01 a.flac",
+		filepath.Join(archived, "CD1/01 a.lrc"):  "CD1/01 a.lrc",
+		filepath.Join(archived, "CD2/01 a.flac"): "CD2/01 a.flac",
+	})
+
+	if err := dropSyncFile(dir, "../outside.flac", true); err == nil {
+		t.Error("dropped a file outside the playlist")
+	}
+}
+
+func TestMoveSyncDir(t *testing.T) {
+	root := syncTempDir(t)
+	writeSyncTree(t, root, "Playlists/Old/01 a.flac", "Playlists/Taken/x")
+
+	from, to := filepath.Join(root, "Playlists/Old"), filepath.Join(root, "Playlists/New")
+
+	if _, err := moveSyncDir(root, from, filepath.Join(root, "Playlists/Taken")); err == nil {
+		t.Error("merged into an existing folder")
+	}
+
+	if _, err := moveSyncDir(root, from, root); err == nil {
+		t.Error("moved onto the root")
+	}
+
+	moved, err := moveSyncDir(root, from, to)
+	if err != nil || !moved {
+		t.Fatalf("moved %v: %v", moved, err)
+	}
+
+	checkSyncTree(t, to, map[string]string{"01 a.flac": "Playlists/Old/01 a.flac"})
+
+	// already moved, or deleted by hand
+	if moved, err := moveSyncDir(root, from, to); moved || err != nil {
+		t.Errorf("moved %v: %v", moved, err)
+	}
+}
+
+func TestSyncIndex(t *testing.T) {
+	root := syncTempDir(t)
+
+	index, err := readSyncIndex(root)
+	if err != nil || len(index) != 0 {
+		t.Fatalf("got %v, %v", index, err)
+	}
+
+	index["0b5df380-47d3-48fe-ae66-8f0dba90b1ee"] = "Playlists/Mine"
+	if err := writeSyncIndex(root, index); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readSyncIndex(root)
+	if err != nil || got["0b5df380-47d3-48fe-ae66-8f0dba90b1ee"] != "Playlists/Mine" {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
@@ -0,0 +1,190 @@
+package tidl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tags is an ordered list of vorbis comments. Field names are case
+// insensitive, new ones are written upper case and empty values are never
+// added.
+type Tags [][2]string
+
+// Get returns all values of key
+func (tg Tags) Get(key string) []string {
+	var values []string
+	for _, tag := range tg {
+		if strings.EqualFold(tag[0], key) {
+			values = append(values, tag[1])
+		}
+	}
+
+	return values
+}
+
+// Has reports whether key has any value
+func (tg Tags) Has(key string) bool {
+	return len(tg.Get(key)) > 0
+}
+
+// Add appends a value to key, blank values are skipped
+func (tg *Tags) Add(key, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" || !validTagKey(key) {
+		return
+	}
+
+	*tg = append(*tg, [2]string{strings.ToUpper(key), value})
+}
+
+// AddAll adds every tag in list
+func (tg *Tags) AddAll(list [][2]string) {
+	for _, tag := range list {
+		tg.Add(tag[0], tag[1])
+	}
+}
+
+// Set replaces all values of key with values, keeping the position of the
+// first one. Setting no non-blank values removes the key.
+func (tg *Tags) Set(key string, values ...string) {
+	var set Tags
+	for _, value := range values {
+		set.Add(key, value)
+	}
+
+	out := make(Tags, 0, len(*tg)+len(set))
+	for _, tag := range *tg {
+		if !strings.EqualFold(tag[0], key) {
+			out = append(out, tag)
+			continue
+		}
+
+		out = append(out, set...)
+		set = nil
+	}
+
+	*tg = append(out, set...)
+}
+
+// Remove drops every value of key
+func (tg *Tags) Remove(key string) {
+	tg.Set(key)
+}
+
+// Keys returns the distinct field names in order of first appearance, upper
+// cased
+func (tg Tags) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+
+	for _, tag := range tg {
+		key := strings.ToUpper(tag[0])
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// field names are printable ascii without '='
+func validTagKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7d || key[i] == '=' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MergePolicy decides what happens to tags already in a file when new ones
+// are written
+type MergePolicy int
+
+const (
+	// MergeReplace replaces the fields we have values for and keeps the rest
+	MergeReplace MergePolicy = iota
+	// MergeKeep only adds fields the file doesn't have yet
+	MergeKeep
+	// MergeClear drops everything that was in the file
+	MergeClear
+)
+
+// ParseMergePolicy parses "replace", "keep" or "clear"
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "replace":
+		return MergeReplace, nil
+	case "keep":
+		return MergeKeep, nil
+	case "clear":
+		return MergeClear, nil
+	}
+
+	return MergeReplace, fmt.Errorf("unknown tag merge policy: %q", s)
+}
+
+// Merge combines the tags already in a file with new ones
+func (p MergePolicy) Merge(existing, tags Tags) Tags {
+	if p == MergeClear {
+		return append(Tags{}, tags...)
+	}
+
+	out := append(Tags{}, existing...)
+	for _, key := range tags.Keys() {
+		if p == MergeKeep && out.Has(key) {
+			continue
+		}
+
+		out.Set(key, tags.Get(key)...)
+	}
+
+	return out
+}
+
+// DiffTags lists what changed between two sets of tags, "-KEY=value" for
+// values that are gone and "+KEY=value" for new ones
+func DiffTags(before, after Tags) []string {
+	var diff []string
+
+	keys := before.Keys()
+	for _, key := range after.Keys() {
+		if !before.Has(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		was, now := before.Get(key), after.Get(key)
+
+		for _, value := range was {
+			if !containsString(now, value) {
+				diff = append(diff, "-"+key+"="+value)
+			}
+		}
+
+		for _, value := range now {
+			if !containsString(was, value) {
+				diff = append(diff, "+"+key+"="+value)
+			}
+		}
+	}
+
+	return diff
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,180 @@
+package tidl
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTagsSet(t *testing.T) {
+	var tags Tags
+	tags.Add("title", "Song")
+	tags.Add("ARTIST", "One")
+	tags.Add("artist", "Two")
+	tags.Add("ALBUM", "  ")
+	tags.Add("BAD=KEY", "x")
+	tags.Add("DATE", "2020")
+
+	if want := "[[TITLE Song] [ARTIST One] [ARTIST Two] [DATE 2020]]"; fmt.Sprint(tags) != want {
+		t.Fatalf("got %v, want %v", tags, want)
+	}
+
+	tests := []struct {
+		key    string
+		values []string
+		want   string
+	}{
+		// replaced values stay where the first old one was
+		{"Artist", []string{"Three"}, "[[TITLE Song] [ARTIST Three] [DATE 2020]]"},
+		{"ARTIST", []string{"Four", "Five"}, "[[TITLE Song] [ARTIST Four] [ARTIST Five] [DATE 2020]]"},
+		{"GENRE", []string{"Rock"}, "[[TITLE Song] [ARTIST Four] [ARTIST Five] [DATE 2020] [GENRE Rock]]"},
+		{"DATE", []string{" "}, "[[TITLE Song] [ARTIST Four] [ARTIST Five] [GENRE Rock]]"},
+		{"GENRE", nil, "[[TITLE Song] [ARTIST Four] [ARTIST Five]]"},
+	}
+
+	for _, tt := range tests {
+		tags.Set(tt.key, tt.values...)
+		if fmt.Sprint(tags) != tt.want {
+			t.Errorf("Set(%v, %q): got %v, want %v", tt.key, tt.values, tags, tt.want)
+		}
+	}
+
+	if fmt.Sprint(tags.Keys()) != "[TITLE ARTIST]" || !tags.Has("title") || tags.Has("DATE") {
+		t.Errorf("got keys %v", tags.Keys())
+	}
+}
+
+func TestMergePolicy(t *testing.T) {
+	existing := Tags{{"TITLE", "Old"}, {"ARTIST", "A"}, {"ARTIST", "B"}, {"COMMENT", "mine"}}
+	tags := Tags{{"TITLE", "New"}, {"ARTIST", "C"}, {"ISRC", "X"}}
+
+	tests := []struct {
+		policy MergePolicy
+		want   string
+	}{
+		{MergeReplace, "[[TITLE New] [ARTIST C] [COMMENT mine] [ISRC X]]"},
+		{MergeKeep, "[[TITLE Old] [ARTIST A] [ARTIST B] [COMMENT mine] [ISRC X]]"},
+		{MergeClear, "[[TITLE New] [ARTIST C] [ISRC X]]"},
+	}
+
+	for _, tt := range tests {
+		once := tt.policy.Merge(existing, tags)
+		if fmt.Sprint(once) != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.policy, once, tt.want)
+		}
+
+		// writing the same tags again changes nothing
+		if twice := tt.policy.Merge(once, tags); fmt.Sprint(twice) != fmt.Sprint(once) {
+			t.Errorf("%v: not idempotent, got %v", tt.policy, twice)
+		}
+	}
+
+	if fmt.Sprint(existing) != "[[TITLE Old] [ARTIST A] [ARTIST B] [COMMENT mine]]" {
+		t.Errorf("existing tags modified: %v", existing)
+	}
+}
+
+func TestParseMergePolicy(t *testing.T) {
+	tests := map[string]MergePolicy{"": MergeReplace, "replace": MergeReplace, "Keep": MergeKeep, " clear ": MergeClear}
+
+	for in, want := range tests {
+		if got, err := ParseMergePolicy(in); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	if _, err := ParseMergePolicy("bogus"); err == nil {
+		t.Error("bogus parsed")
+	}
+}
+
+func TestDiffTags(t *testing.T) {
+	before := Tags{{"TITLE", "Old"}, {"ARTIST", "A"}, {"ARTIST", "B"}}
+	after := Tags{{"TITLE", "New"}, {"ARTIST", "B"}, {"ISRC", "X"}}
+
+	want := "[-TITLE=Old +TITLE=New -ARTIST=A +ISRC=X]"
+	if got := DiffTags(before, after); fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := DiffTags(after, after); len(got) != 0 {
+		t.Errorf("got %v for the same tags", got)
+	}
+}
+
+func TestFlacTags(t *testing.T) {
+	al := Album{
+		Title:           "Album",
+		Artist:          Artist{Name: "One"},
+		NumberOfTracks:  "12",
+		NumberOfVolumes: 2,
+		UPC:             "0602435",
+		ReleaseDate:     "2020-01-02",
+	}
+
+	tr := Track{
+		ID:           "7",
+		Title:        "Song",
+		Artist:       Artist{Name: "One"},
+		Album:        al,
+		TrackNumber:  "3",
+		VolumeNumber: "2",
+		Copyright:    "(P) 2020 Label",
+		ISRC:         "USABC2000001",
+		BPM:          120,
+		Key:          "A",
+		KeyScale:     "MINOR",
+		Explicit:     true,
+		Credits: []Credit{
+			{Type: "Composer", Contributors: []Contributor{{Name: "Writer"}}},
+			{Type: "Record Label", Contributors: []Contributor{{Name: "Label"}}},
+			{Type: "Guitar", Contributors: []Contributor{{Name: "Player"}}},
+		},
+		discTracks: 5,
+	}
+
+	want := Tags{
+		{"TITLE", "Song"},
+		{"ALBUM", "Album"},
+		{"TRACKNUMBER", "3"},
+		{"TRACKTOTAL", "5"},
+		{"DISCNUMBER", "2"},
+		{"DISCTOTAL", "2"},
+		{"ARTIST", "One"},
+		{"ARTISTS", "One"},
+		{"ALBUMARTIST", "One"},
+		{"COPYRIGHT", "(P) 2020 Label"},
+		{"TIDAL_TRACK_ID", "7"},
+		{"ISRC", "USABC2000001"},
+		{"BARCODE", "0602435"},
+		{"LABEL", "Label"},
+		{"DATE", "2020-01-02"},
+		{"BPM", "120"},
+		{"KEY", "Am"},
+		{"COMPOSER", "Writer"},
+		{"PERFORMER", "Player (guitar)"},
+		{"ITUNESADVISORY", "1"},
+	}
+
+	td := &Tidal{}
+	if got := td.flacTags(td.ArtistFormat.apply(tr)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("album track:\ngot  %v\nwant %v", got, want)
+	}
+
+	// playlist tracks are numbered and titled by the playlist, discs don't
+	// apply
+	tr.Playlist = Playlist{ID: "p", Title: "Mine", NumberOfTracks: 40}
+	tr.TrackNumber = "17"
+
+	got := td.flacTags(td.ArtistFormat.apply(tr))
+	for _, check := range [][2]string{
+		{"ALBUM", "[Mine]"},
+		{"TRACKNUMBER", "[17]"},
+		{"TRACKTOTAL", "[40]"},
+		{"DISCNUMBER", "[]"},
+		{"COMMENTS", "[Original Album Title: Album]"},
+	} {
+		if values := fmt.Sprint(got.Get(check[0])); values != check[1] {
+			t.Errorf("playlist track %v: got %v, want %v", check[0], values, check[1])
+		}
+	}
+}
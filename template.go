@@ -0,0 +1,308 @@
+package tidl
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Template renders the path of a track, relative to the library root and
+// without an extension, e.g.
+//
+//	{albumartist}/{year} - {album}/{track:02} {title}
+//
+// Components are sanitized after rendering, so a "/" in a title never creates
+// a directory. Components that render empty are dropped.
+type Template struct {
+	raw        string
+	components [][]templatePart
+	sanitizer  Sanitizer
+}
+
+// room left in the file name for an extension like .flac or .part
+const extensionReserve = 16
+
+type templatePart struct {
+	literal string
+	field   string
+	width   int
+}
+
+// fields that can be used in a template
+var templateFields = map[string]func(tr Track) string{
+	"albumartist": func(tr Track) string { return tr.albumArtist() },
+	"artist":      func(tr Track) string { return tr.Artist.Name },
+	"artists":     func(tr Track) string { return tr.artistName() },
+	"album":       func(tr Track) string { return tr.Album.Title },
+	"title":       func(tr Track) string { return tr.titleName() },
+	"track":       func(tr Track) string { return tr.TrackNumber.String() },
+	"tracktotal":  func(tr Track) string { return tr.trackTotal() },
+	"disc":        func(tr Track) string { return tr.disc() },
+	"disctotal":   func(tr Track) string { return tr.discTotal() },
+	// CD1, CD2... for albums with more than one disc, empty otherwise
+	"discfolder": func(tr Track) string {
+		if tr.Album.NumberOfVolumes < 2 {
+			return ""
+		}
+		return "CD" + tr.disc()
+	},
+	"year": func(tr Track) string {
+		if len(tr.Album.ReleaseDate) < 4 {
+			return ""
+		}
+		return tr.Album.ReleaseDate[:4]
+	},
+	"date":     func(tr Track) string { return tr.Album.ReleaseDate },
+	"id":       func(tr Track) string { return tr.ID.String() },
+	"albumid":  func(tr Track) string { return tr.Album.ID.String() },
+	"playlist": func(tr Track) string { return tr.Playlist.Title },
+	"snapshot": func(tr Track) string { return tr.Playlist.Snapshot },
+	"quality":  func(tr Track) string { return tr.AudioQuality },
+}
+
+// the file name has to contain one of these or every track collides
+var uniqueFields = []string{"title", "track", "id"}
+
+var (
+	// DefaultAlbumTemplate is the classic Artist/Album/Artist - Title layout,
+	// with the tracks of multi disc albums in CD1/, CD2/... folders so titles
+	// repeated across discs don't collide
+	DefaultAlbumTemplate = MustParseTemplate("{albumartist}/{album}/{discfolder}/{artist} - {title}")
+	// DefaultPlaylistTemplate is used for playlists and artist top tracks
+	DefaultPlaylistTemplate = MustParseTemplate("Playlists/{playlist}/{artist} - {title}")
+	// DefaultMixTemplate is used for mix and radio snapshots
+	DefaultMixTemplate = MustParseTemplate("Mixes/{playlist}/{snapshot}/{artist} - {title}")
+)
+
+// ErrPathCollision is returned when a template renders the same path for
+// different tracks
+var ErrPathCollision = errors.New("template produces colliding paths")
+
+// ParseTemplate compiles a path template
+func ParseTemplate(s string) (*Template, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty template")
+	}
+
+	if strings.HasPrefix(s, "/") {
+		return nil, errors.New("template must be relative to the library root")
+	}
+
+	tp := &Template{raw: s}
+
+	for _, component := range strings.Split(s, "/") {
+		if component == "" || component == "." || component == ".." {
+			return nil, fmt.Errorf("invalid path component %q in template", component)
+		}
+
+		parts, err := parseTemplateComponent(component)
+		if err != nil {
+			return nil, err
+		}
+
+		tp.components = append(tp.components, parts)
+	}
+
+	unique := false
+	for _, part := range tp.components[len(tp.components)-1] {
+		for _, field := range uniqueFields {
+			unique = unique || part.field == field
+		}
+	}
+
+	if !unique {
+		return nil, fmt.Errorf("%w: file name needs one of {%v}", ErrPathCollision, strings.Join(uniqueFields, "}, {"))
+	}
+
+	return tp, nil
+}
+
+// MustParseTemplate is like ParseTemplate but panics on error
+func MustParseTemplate(s string) *Template {
+	tp, err := ParseTemplate(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return tp
+}
+
+func parseTemplateComponent(s string) ([]templatePart, error) {
+	var parts []templatePart
+
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			if strings.IndexByte(s, '}') >= 0 {
+				return nil, fmt.Errorf("unmatched } in template")
+			}
+			parts = append(parts, templatePart{literal: s})
+			break
+		}
+
+		if open > 0 {
+			if strings.IndexByte(s[:open], '}') >= 0 {
+				return nil, fmt.Errorf("unmatched } in template")
+			}
+			parts = append(parts, templatePart{literal: s[:open]})
+		}
+
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unmatched { in template")
+		}
+
+		part, err := parseTemplateField(s[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, part)
+		s = s[open+end+1:]
+	}
+
+	return parts, nil
+}
+
+func parseTemplateField(s string) (templatePart, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	var format string
+
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name, format = name[:i], name[i+1:]
+	}
+
+	if _, ok := templateFields[name]; !ok {
+		return templatePart{}, fmt.Errorf("unknown template field {%v}", name)
+	}
+
+	part := templatePart{field: name}
+	if format != "" {
+		width, err := strconv.Atoi(format)
+		if err != nil || width < 0 {
+			return templatePart{}, fmt.Errorf("invalid format %q for {%v}", format, name)
+		}
+		part.width = width
+	}
+
+	return part, nil
+}
+
+func (tp *Template) String() string {
+	return tp.raw
+}
+
+// WithSanitizer returns a copy of the template that cleans up components
+// with s
+func (tp *Template) WithSanitizer(s Sanitizer) *Template {
+	cp := *tp
+	cp.sanitizer = s
+	return &cp
+}
+
+// Render returns the path of tr relative to the library root
+func (tp *Template) Render(tr Track) string {
+	var components []string
+
+	for i, parts := range tp.components {
+		var b strings.Builder
+		for _, part := range parts {
+			if part.field == "" {
+				b.WriteString(part.literal)
+				continue
+			}
+
+			value := templateFields[part.field](tr)
+			if part.width > 0 {
+				if n, err := strconv.Atoi(value); err == nil {
+					value = fmt.Sprintf("%0*d", part.width, n)
+				}
+			}
+
+			b.WriteString(value)
+		}
+
+		if strings.TrimSpace(b.String()) == "" {
+			continue
+		}
+
+		if i < len(tp.components)-1 {
+			components = append(components, tp.sanitizer.component(b.String(), 0))
+			continue
+		}
+
+		reserve := extensionReserve + len(tr.pathSuffix)
+		components = append(components, tp.sanitizer.component(b.String(), reserve)+tr.pathSuffix)
+	}
+
+	return strings.Join(components, "/")
+}
+
+// Validate renders every track and returns ErrPathCollision if two different
+// tracks end up at the same path. Paths are compared case-insensitively since
+// plenty of filesystems are.
+func (tp *Template) Validate(tracks []Track) error {
+	seen := make(map[string]Track)
+
+	for _, tr := range tracks {
+		path := tp.Render(tr)
+		key := strings.ToLower(path)
+
+		if other, ok := seen[key]; ok && other.ID != tr.ID {
+			return fmt.Errorf("%w: %q and %q both render to %q", ErrPathCollision, other.Title, tr.Title, path)
+		}
+
+		seen[key] = tr
+	}
+
+	return nil
+}
+
+// Disambiguate is Validate for when a collision shouldn't stop a download,
+// see Tidal.SuffixCollisions: tracks that render to the same path as an
+// earlier track get a " (2)", " (3)"... suffix on their file name. It returns
+// an ErrPathCollision for every track it renamed.
+func (tp *Template) Disambiguate(tracks []Track) []error {
+	var errs []error
+	seen := make(map[string]Track)
+
+	for i := range tracks {
+		tracks[i].pathSuffix = ""
+		path := tp.Render(tracks[i])
+
+		other, ok := seen[strings.ToLower(path)]
+		if ok && other.ID != tracks[i].ID {
+			for n := 2; ok; n++ {
+				tracks[i].pathSuffix = fmt.Sprintf(" (%d)", n)
+				_, ok = seen[strings.ToLower(tp.Render(tracks[i]))]
+			}
+
+			errs = append(errs, fmt.Errorf("%w: %q and %q both render to %q, saving %q as %q",
+				ErrPathCollision, other.Title, tracks[i].Title, path, tracks[i].Title, tp.Render(tracks[i])))
+		}
+
+		seen[strings.ToLower(tp.Render(tracks[i]))] = tracks[i]
+	}
+
+	return errs
+}
+
+// commonDir returns the deepest directory shared by all paths. Paths are
+// rendered with "/" whatever the OS, so they're split on that.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	dir := path.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for dir != "." && dir != "/" && !strings.HasPrefix(p, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+
+	return dir
+}
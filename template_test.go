@@ -0,0 +1,164 @@
+package tidl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// discAlbum is a two disc album with the same titles on both discs, the way
+// live and bonus discs often are
+func discAlbum() (Album, []Track) {
+	al := Album{ID: "1", Title: "Live", Artist: Artist{Name: "Band"}, NumberOfTracks: "5"}
+
+	listing := []struct{ disc, track, title string }{
+		{"1", "1", "Intro"},
+		{"1", "2", "Song"},
+		{"1", "3", "Outro"},
+		{"2", "1", "Intro"},
+		{"2", "2", "Song"},
+	}
+
+	var tracks []Track
+	for i, l := range listing {
+		tracks = append(tracks, Track{
+			ID:           json.Number(fmt.Sprint(10 + i)),
+			Title:        l.title,
+			Artist:       Artist{Name: "Band"},
+			TrackNumber:  json.Number(l.track),
+			VolumeNumber: json.Number(l.disc),
+		})
+	}
+
+	return numberDiscs(al, tracks), tracks
+}
+
+func TestDefaultAlbumTemplateMultiDisc(t *testing.T) {
+	al, tracks := discAlbum()
+	if al.NumberOfVolumes != 2 {
+		t.Fatalf("got %v volumes, want 2", al.NumberOfVolumes)
+	}
+
+	if err := DefaultAlbumTemplate.Validate(tracks); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := DefaultAlbumTemplate.Render(tracks[3]), "Band/Live/CD2/Band - Intro"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// without the disc folder the repeated titles collide
+	flat := MustParseTemplate("{albumartist}/{album}/{artist} - {title}")
+	if err := flat.Validate(tracks); !errors.Is(err, ErrPathCollision) {
+		t.Errorf("got %v, want ErrPathCollision", err)
+	}
+}
+
+func TestDefaultAlbumTemplateSingleDisc(t *testing.T) {
+	al := Album{ID: "1", Title: "Studio", Artist: Artist{Name: "Band"}, NumberOfTracks: "1"}
+	tracks := []Track{{ID: "10", Title: "Song", Artist: Artist{Name: "Band"}, TrackNumber: "1"}}
+	numberDiscs(al, tracks)
+
+	if got, want := DefaultAlbumTemplate.Render(tracks[0]), "Band/Studio/Band - Song"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTemplateTrackTotal(t *testing.T) {
+	_, tracks := discAlbum()
+	tmpl := MustParseTemplate("{album}/{disc}-{disctotal}/{track:02} of {tracktotal:02} {title}")
+
+	want := []string{
+		"Live/1-2/01 of 03 Intro",
+		"Live/1-2/02 of 03 Song",
+		"Live/1-2/03 of 03 Outro",
+		"Live/2-2/01 of 02 Intro",
+		"Live/2-2/02 of 02 Song",
+	}
+
+	for i, tr := range tracks {
+		if got := tmpl.Render(tr); got != want[i] {
+			t.Errorf("got %q, want %q", got, want[i])
+		}
+	}
+}
+
+func TestDisambiguate(t *testing.T) {
+	_, tracks := discAlbum()
+	flat := MustParseTemplate("{albumartist}/{album}/{artist} - {title}")
+
+	errs := flat.Disambiguate(tracks)
+	if len(errs) != 2 {
+		t.Fatalf("got %v collisions, want 2: %v", len(errs), errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrPathCollision) {
+			t.Errorf("got %v, want ErrPathCollision", err)
+		}
+	}
+
+	want := []string{
+		"Band/Live/Band - Intro",
+		"Band/Live/Band - Song",
+		"Band/Live/Band - Outro",
+		"Band/Live/Band - Intro (2)",
+		"Band/Live/Band - Song (2)",
+	}
+
+	for i, tr := range tracks {
+		if got := flat.Render(tr); got != want[i] {
+			t.Errorf("got %q, want %q", got, want[i])
+		}
+	}
+
+	if err := flat.Validate(tracks); err != nil {
+		t.Errorf("still colliding: %v", err)
+	}
+
+	// running it again gives the same names
+	if errs := flat.Disambiguate(tracks); len(errs) != 2 || flat.Render(tracks[4]) != want[4] {
+		t.Errorf("not stable: %v, %q", errs, flat.Render(tracks[4]))
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	flat := MustParseTemplate("{albumartist}/{album}/{artist} - {title}")
+
+	_, tracks := discAlbum()
+	td := &Tidal{}
+	if renamed, err := td.checkPaths(flat, tracks); !errors.Is(err, ErrPathCollision) || len(renamed) > 0 {
+		t.Errorf("got %v, %v, want ErrPathCollision", renamed, err)
+	}
+	if got := flat.Render(tracks[3]); got != "Band/Live/Band - Intro" {
+		t.Errorf("renamed to %q without SuffixCollisions", got)
+	}
+
+	td.SuffixCollisions = true
+	if renamed, err := td.checkPaths(flat, tracks); err != nil || len(renamed) != 2 {
+		t.Errorf("got %v, %v, want 2 renames", renamed, err)
+	}
+	if got := flat.Render(tracks[3]); got != "Band/Live/Band - Intro (2)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCommonDir(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"Band/Live/CD1/Intro"}, "Band/Live/CD1"},
+		{[]string{"Band/Live/CD1/Intro", "Band/Live/CD2/Intro"}, "Band/Live"},
+		{[]string{"Band/Live/Intro", "Band/Live/Outro"}, "Band/Live"},
+		{[]string{"Band/Live/Intro", "Band/Live Again/Intro"}, "Band"},
+		{[]string{"Band/Intro", "Other/Intro"}, "."},
+	}
+
+	for _, tt := range tests {
+		if got := commonDir(tt.paths); got != tt.want {
+			t.Errorf("commonDir(%q) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
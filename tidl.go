@@ -1,9 +1,7 @@
 package tidl
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,9 +15,6 @@ import (
 	"strconv"
 	"strings"
 
-	// TODO(ts): look at replacing bitio
-
-	"github.com/icza/bitio"
 	"github.com/mewkiz/flac"
 	"github.com/mewkiz/flac/meta"
 
@@ -74,13 +69,72 @@ type Tidal struct {
 	SessionID   string      `json:"sessionID"`
 	CountryCode string      `json:"countryCode"`
 	UserID      json.Number `json:"userId"`
+
+	// DownloadVideos also fetches the music videos listed on an album
+	DownloadVideos bool `json:"-"`
+	// VideoResolution is the preferred maximum video height, 0 for the best
+	VideoResolution int `json:"-"`
+	// Explicitness picks between explicit and clean versions of a release
+	Explicitness Explicitness `json:"-"`
+
+	// Root is the library root, the working directory when empty
+	Root string `json:"-"`
+	// AlbumTemplate lays out album downloads, DefaultAlbumTemplate when nil
+	AlbumTemplate *Template `json:"-"`
+	// PlaylistTemplate lays out playlist downloads, DefaultPlaylistTemplate when nil
+	PlaylistTemplate *Template `json:"-"`
+	// MixTemplate lays out mix snapshots, DefaultMixTemplate when nil
+	MixTemplate *Template `json:"-"`
+	// SuffixCollisions saves tracks whose paths collide with a " (2)", " (3)"...
+	// suffix instead of refusing to download them
+	SuffixCollisions bool `json:"-"`
+	// Sanitizer cleans up file names rendered by the templates
+	Sanitizer Sanitizer `json:"-"`
+	// ArtistFormat joins multiple artists in tags and file names
+	ArtistFormat ArtistFormat `json:"-"`
+	// Lyrics fetches lyrics, embeds them and writes .lrc files next to tracks
+	Lyrics bool `json:"-"`
+	// CoverSize is the largest cover rendition embedded in tracks, 1280 when 0
+	CoverSize int `json:"-"`
+	// MaxPictureBytes caps the size of embedded pictures, smaller renditions
+	// are tried until one fits
+	MaxPictureBytes int `json:"-"`
+	// ArtistPicture also embeds the album artist's picture
+	ArtistPicture bool `json:"-"`
+	// TagMerge decides what happens to tags already in a downloaded stream
+	TagMerge MergePolicy `json:"-"`
+	// ReplayGain writes ReplayGain tags once an album is downloaded
+	ReplayGain bool `json:"-"`
+	// PlaylistFormats are the playlist files written for albums and playlists
+	PlaylistFormats []PlaylistFormat `json:"-"`
+	// PlaylistMode decides where playlist tracks are downloaded to
+	PlaylistMode PlaylistMode `json:"-"`
+	// AlbumImage also joins FLAC albums into one image with a cue sheet
+	AlbumImage bool `json:"-"`
+	// SeekTable adds a SEEKTABLE with points this far apart to downloaded
+	// FLAC files that lack one, 0 leaves them alone
+	SeekTable time.Duration `json:"-"`
+
+	// discographies caches artist discographies for version lookups
+	discographies map[string][]Album
 }
 
 // Artist struct
 type Artist struct {
-	ID   json.Number `json:"id"`
-	Name string      `json:"name"`
-	Type string      `json:"type"`
+	ID          json.Number  `json:"id"`
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Picture     string       `json:"picture,omitempty"`
+	Popularity  int          `json:"popularity,omitempty"`
+	URL         string       `json:"url,omitempty"`
+	ArtistTypes []string     `json:"artistTypes,omitempty"`
+	ArtistRoles []ArtistRole `json:"artistRoles,omitempty"`
+}
+
+// ArtistRole struct
+type ArtistRole struct {
+	CategoryID int    `json:"categoryId"`
+	Category   string `json:"category"`
 }
 
 // Album struct
@@ -89,6 +143,7 @@ type Album struct {
 	Title                string      `json:"title"`
 	ID                   json.Number `json:"id"`
 	NumberOfTracks       json.Number `json:"numberOfTracks"`
+	NumberOfVideos       int         `json:"numberOfVideos"`
 	Explicit             bool        `json:"explicit,omitempty"`
 	Copyright            string      `json:"copyright,omitempty"`
 	AudioQuality         string      `json:"audioQuality"`
@@ -98,7 +153,17 @@ type Album struct {
 	Popularity           float64     `json:"popularity,omitempty"`
 	Artist               Artist      `json:"artist"`
 	Cover                string      `json:"cover"`
-	artBody              []byte
+	UPC                  string      `json:"upc,omitempty"`
+	Version              string      `json:"version,omitempty"`
+	NumberOfVolumes      int         `json:"numberOfVolumes,omitempty"`
+	Label                string      `json:"label,omitempty"`
+	MediaMetadata        struct {
+		Tags []string `json:"tags"`
+	} `json:"mediaMetadata"`
+	artBody      []byte
+	edited       bool
+	pictures     []*meta.Picture
+	picturesDone bool
 }
 
 type Playlist struct {
@@ -122,6 +187,9 @@ type Playlist struct {
 	PublicPlaylist bool
 	Title string
 
+	// Snapshot is the date a mix was captured on
+	Snapshot string `json:",omitempty"`
+
 	Tracks []Track `json:"-"`
 
 	artBody []byte
@@ -150,8 +218,24 @@ type Track struct {
 	Copyright    string      `json:"copyright"`
 	Popularity   int         `json:"popularity"`
 	TrackNumber  json.Number `json:"trackNumber"`
+	VolumeNumber json.Number `json:"volumeNumber"`
 	Duration     json.Number `json:"duration"`
 	AudioQuality string      `json:"audioQuality"`
+	ISRC         string      `json:"isrc"`
+	Version      string      `json:"version,omitempty"`
+	BPM          int         `json:"bpm,omitempty"`
+	Key          string      `json:"key,omitempty"`
+	KeyScale     string      `json:"keyScale,omitempty"`
+	Credits      []Credit    `json:"credits,omitempty"`
+	edited       bool
+	lyrics       Lyrics
+	// display strings set by ArtistFormat
+	displayArtist string
+	displayTitle  string
+	// number of tracks on the track's disc, 0 when unknown
+	discTracks int
+	// added to the file name when another track renders to the same path
+	pathSuffix string
 }
 
 // Search struct
@@ -191,6 +275,43 @@ func (t *Tidal) get(dest string, query *url.Values, s interface{}) error {
 	return json.NewDecoder(res.Body).Decode(&s)
 }
 
+// pageSize is how many items getPages asks for at a time
+const pageSize = 100
+
+// getPages walks a paged listing, calling item with every raw item until
+// totalNumberOfItems have been seen
+func (t *Tidal) getPages(dest string, query url.Values, item func(json.RawMessage) error) error {
+	for offset := 0; ; {
+		var s struct {
+			TotalNumberOfItems int               `json:"totalNumberOfItems"`
+			Items              []json.RawMessage `json:"items"`
+		}
+
+		// get adds the country code, so every page starts from a fresh copy
+		page := url.Values{}
+		for k, v := range query {
+			page[k] = append([]string(nil), v...)
+		}
+		page.Set("limit", strconv.Itoa(pageSize))
+		page.Set("offset", strconv.Itoa(offset))
+
+		if err := t.get(dest, &page, &s); err != nil {
+			return err
+		}
+
+		for _, raw := range s.Items {
+			if err := item(raw); err != nil {
+				return err
+			}
+		}
+
+		offset += len(s.Items)
+		if len(s.Items) == 0 || offset >= s.TotalNumberOfItems {
+			return nil
+		}
+	}
+}
+
 func (t *Tidal) CheckSession() (bool, error) {
 	//if self.user is None or not self.user.id or not self.session_id:
 	//return False
@@ -287,6 +408,31 @@ func (t *Tidal) GetAlbum(id string) (Album, error) {
 	return s, err
 }
 
+// getAlbumInfo is GetAlbum without fetching the cover
+func (t *Tidal) getAlbumInfo(id string) (Album, error) {
+	if album, ok := t.albumMap[id]; ok {
+		return album, nil
+	}
+
+	var s Album
+	if err := t.get("albums/"+id, &url.Values{}, &s); err != nil {
+		return s, err
+	}
+
+	if s.Duration == 0 {
+		return s, errors.New("album unavailable")
+	}
+
+	t.albumMap[id] = s
+	return s, nil
+}
+
+// GetTrack func
+func (t *Tidal) GetTrack(id string) (Track, error) {
+	var s Track
+	return s, t.get("tracks/"+id, &url.Values{}, &s)
+}
+
 // GetAlbumTracks func
 func (t *Tidal) GetAlbumTracks(id string) ([]Track, error) {
 	var s struct {
@@ -382,55 +528,15 @@ func (t *Tidal) GetArtist(artist string) (Artist, error) {
 
 // GetArtistAlbums func
 func (t *Tidal) GetArtistAlbums(artist string, l int) ([]Album, error) {
-	var s Search
-	var limit string
-
-	if l > 0 {
-		limit = strconv.Itoa(l)
-	}
-
-	err := t.get(fmt.Sprintf("artists/%s/albums", artist), &url.Values{
-		"limit": {limit},
-	}, &s)
-
-	if err != nil {
-		return s.Items, err
-	}
-
-	for _, album := range s.Items {
-		t.albumMap[album.ID.String()] = album
-	}
-
-	return s.Items, nil
+	return t.getArtistAlbums(artist, "", l)
 }
 
 func (t *Tidal) GetArtistEP(artist string, l int) ([]Album, error) {
-	var s Search
-	var limit string
-
-	if l > 0 {
-		limit = strconv.Itoa(l)
-	}
-
-	err := t.get(fmt.Sprintf("artists/%s/albums", artist), &url.Values{
-		"limit":  {limit},
-		"filter": {"EPSANDSINGLES"},
-	}, &s)
-
-	if err != nil {
-		return s.Items, err
-	}
-
-	for _, album := range s.Items {
-		t.albumMap[album.ID.String()] = album
-	}
-
-	return s.Items, nil
+	return t.getArtistAlbums(artist, "EPSANDSINGLES", l)
 }
 
 func (al *Album) GetArt() ([]byte, error) {
-	u := "https://resources.tidal.com/images/" + strings.Replace(al.Cover, "-", "/", -1) + "/1280x1280.jpg"
-	res, err := http.Get(u)
+	res, err := http.Get(al.GetArtURL(1280))
 	if err != nil {
 		return nil, err
 	}
@@ -441,6 +547,8 @@ func (al *Album) GetArt() ([]byte, error) {
 }
 
 func (t *Tidal) DownloadAlbum(al Album) error {
+	al = t.PreferredAlbum(al)
+
 	tracks, err := t.GetAlbumTracks(al.ID.String())
 	if err != nil {
 		return err
@@ -450,7 +558,42 @@ func (t *Tidal) DownloadAlbum(al Album) error {
 		return errors.New("album unavailable")
 	}
 
-	dirs := clean(al.Artists[0].Name) + "/" + clean(al.Title)
+	// the folders and artist info come from the tracks and artists, so
+	// there's nowhere to put anything without them
+	if len(tracks) == 0 {
+		return errors.New("album has no tracks")
+	}
+	if len(al.Artists) == 0 {
+		return errors.New("album has no artists")
+	}
+
+	tmpl := t.albumTemplate()
+
+	al = numberDiscs(al, tracks)
+
+	for i := range tracks {
+		tracks[i] = t.ArtistFormat.apply(tracks[i])
+	}
+
+	// credits are a nicety, tracks still get tagged without them
+	if credits, err := t.GetAlbumCredits(al.ID.String()); err == nil {
+		for i := range tracks {
+			tracks[i].Credits = credits[tracks[i].ID.String()]
+			if label := tracks[i].label(); label != "" && al.Label == "" {
+				al.Label = label
+			}
+		}
+	}
+
+	renamed, err := t.checkPaths(tmpl, tracks)
+	if err != nil {
+		return err
+	}
+	for _, err := range renamed {
+		fmt.Printf("\t%v\n", err)
+	}
+
+	dirs := t.collectionDir(tmpl, tracks)
 	os.MkdirAll(dirs, os.ModePerm)
 
 	metadata, err := json.MarshalIndent(al, "", "\t")
@@ -476,16 +619,121 @@ func (t *Tidal) DownloadAlbum(al Album) error {
 		return err
 	}
 
+	// artist info is a nicety, don't fail the album over it
+	if dir := t.artistDir(tmpl, tracks[0]); dir != "" {
+		t.writeArtistInfo(dir, al.Artists[0].ID.String())
+	}
+
 	for i, track := range tracks {
 		fmt.Printf("\t [%v/%v] %v\n", i+1, len(tracks), track.Title)
-		if err := t.DownloadTrack(dirs, track); err != nil {
+		if err := t.DownloadTrack(tmpl, track); err != nil {
+			return err
+		}
+	}
+
+	if t.ReplayGain {
+		if err := t.replayGain(tmpl, tracks); err != nil {
 			return err
 		}
 	}
 
+	if t.AlbumImage {
+		if err := t.albumImage(dirs, al, tmpl, tracks); err != nil {
+			return err
+		}
+	}
+
+	var entries []playlistEntry
+	for _, tr := range tracks {
+		if path := tr.findFile(t.Root, tmpl); path != "" {
+			entries = append(entries, newPlaylistEntry(path, tr))
+		}
+	}
+
+	if err := t.writePlaylistFiles(dirs, al.Title, entries); err != nil {
+		return err
+	}
+
+	if t.DownloadVideos && al.NumberOfVideos > 0 {
+		videos, err := t.GetAlbumVideos(al.ID.String())
+		if err != nil {
+			return err
+		}
+
+		for i, v := range videos {
+			fmt.Printf("\t [%v/%v] %v (video)\n", i+1, len(videos), v.Title)
+			if err := t.downloadVideo(tmpl, v, al); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+// DownloadAlbumTrack downloads a single track to where it would go as part of
+// its album
+func (t *Tidal) DownloadAlbumTrack(tr Track) error {
+	tr, err := t.albumTrack(t.PreferredTrack(tr))
+	if err != nil {
+		return err
+	}
+
+	return t.DownloadTrack(t.albumTemplate(), tr)
+}
+
+// albumTrack fills in what's needed to tag tr as part of its album
+func (t *Tidal) albumTrack(tr Track) (Track, error) {
+	al, err := t.GetAlbum(tr.Album.ID.String())
+	if err != nil {
+		return tr, err
+	}
+
+	// per disc track totals, and the suffixes DownloadAlbum gives colliding
+	// paths when SuffixCollisions is set, need the rest of the album
+	tracks, err := t.GetAlbumTracks(al.ID.String())
+	if err != nil {
+		return tr, err
+	}
+
+	al = numberDiscs(al, tracks)
+	for i := range tracks {
+		tracks[i] = t.ArtistFormat.apply(tracks[i])
+	}
+	if t.SuffixCollisions {
+		t.albumTemplate().Disambiguate(tracks)
+	}
+
+	for _, other := range tracks {
+		if other.ID == tr.ID {
+			tr.discTracks, tr.pathSuffix = other.discTracks, other.pathSuffix
+		}
+	}
+
+	if len(tr.Credits) == 0 {
+		tr.Credits, _ = t.GetTrackCredits(tr.ID.String())
+	}
+
+	tr.Album = al
+	return t.ArtistFormat.apply(tr), nil
+}
+
+// playlistTrack fills in what's needed to tag tr as number n of a playlist
+func (t *Tidal) playlistTrack(p Playlist, n int, tr Track) Track {
+	tr.Playlist = p
+	tr.TrackNumber = json.Number(strconv.Itoa(n))
+
+	if al, err := t.GetAlbum(tr.Album.ID.String()); err == nil {
+		tr.Album = al
+	}
+
+	if len(tr.Credits) == 0 {
+		tr.Credits, _ = t.GetTrackCredits(tr.ID.String())
+	}
+
+	return t.ArtistFormat.apply(tr)
+}
+
 func (t *Tidal) DownloadPlaylist(p Playlist) error {
 	if p.Duration == 0 {
 		return errors.New("playlist unavailable")
@@ -499,56 +747,115 @@ func (t *Tidal) DownloadPlaylist(p Playlist) error {
 		}
 	}
 
-	root := "Playlists/" + clean(p.Title)
-	os.MkdirAll(root, os.ModePerm)
-
-	metadata, err := json.MarshalIndent(p, "", "\t")
+	body, err := p.GetArt()
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(root+"/meta.json", metadata, 0777)
-	if err != nil {
-		return err
+	return t.downloadPlaylist(t.playlistTemplate(), p, body)
+}
+
+// downloadPlaylist writes the playlist's tracks, numbered by position, to the
+// paths tmpl renders for them
+func (t *Tidal) downloadPlaylist(tmpl *Template, p Playlist, art []byte) error {
+	p.artBody = art
+
+	tracks, sources := t.playlistTracks(p)
+	return t.downloadPlaylistTracks(tmpl, p, tracks, sources)
+}
+
+// playlistTracks returns the tracks of p as they're written to the playlist
+// folder, and the preferred versions they were made from
+func (t *Tidal) playlistTracks(p Playlist) ([]Track, []Track) {
+	tracks := make([]Track, 0, len(p.Tracks))
+	sources := make([]Track, 0, len(p.Tracks))
+	for i, tr := range p.Tracks {
+		// TODO(ts): improve ID3
+		tr = t.PreferredTrack(tr)
+		sources = append(sources, tr)
+		tracks = append(tracks, t.playlistTrack(p, i+1, tr))
 	}
 
-	body, err := p.GetArt()
+	return tracks, sources
+}
+
+func (t *Tidal) downloadPlaylistTracks(tmpl *Template, p Playlist, tracks, sources []Track) error {
+	art := p.artBody
+
+	renamed, err := t.checkPaths(tmpl, tracks)
 	if err != nil {
 		return err
 	}
+	for _, err := range renamed {
+		fmt.Printf("\t%v\n", err)
+	}
 
-	p.artBody = body
+	root := t.collectionDir(tmpl, tracks)
+	os.MkdirAll(root, os.ModePerm)
 
-	err = ioutil.WriteFile(root+"/album.jpg", body, 0777)
+	metadata, err := json.MarshalIndent(p, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	for i, tr := range p.Tracks {
-		fmt.Printf("\t [%v/%v] %v - %v\n", i+1, len(p.Tracks), tr.Artist.Name, tr.Title)
-		// TODO(ts): improve ID3
+	err = ioutil.WriteFile(root+"/meta.json", metadata, 0777)
+	if err != nil {
+		return err
+	}
 
-		tr.Playlist = p
-		tr.TrackNumber = json.Number(strconv.Itoa(i+1))
+	if len(art) > 0 {
+		err = ioutil.WriteFile(root+"/album.jpg", art, 0777)
+		if err != nil {
+			return err
+		}
+	}
 
-		if tr.DoExists(root) {
+	var entries []playlistEntry
+	for i, tr := range tracks {
+		fmt.Printf("\t [%v/%v] %v - %v\n", i+1, len(tracks), tr.Artist.Name, tr.Title)
+
+		switch t.PlaylistMode {
+		case PlaylistReuse:
+			// point at the album copy instead of downloading the track again
+			if path := t.libraryFile(sources[i]); path != "" {
+				entries = append(entries, newPlaylistEntry(path, tr))
+				continue
+			}
+		case PlaylistLibrary, PlaylistSymlink, PlaylistHardlink:
+			src := sources[i]
+			src.Credits = tr.Credits
+
+			path, err := t.playlistLink(tmpl, tr, src)
+			if err != nil {
+				fmt.Printf("\t%v\n", err)
+			}
+
+			if path != "" {
+				entries = append(entries, newPlaylistEntry(path, tr))
+			}
 			continue
 		}
 
-		t.GetAlbum(string(tr.Album.ID))
-		t.DownloadTrack(root, tr)
+		if !tr.DoExists(t.Root, tmpl) {
+			t.DownloadTrack(tmpl, tr)
+		}
+
+		if path := tr.findFile(t.Root, tmpl); path != "" {
+			entries = append(entries, newPlaylistEntry(path, tr))
+		}
 	}
 
-	return nil
+	return t.writePlaylistFiles(root, p.Title, entries)
 }
 
-func (tr Track) GetPath(root string) string {
-	return root + "/" + clean(tr.Artist.Name) + " - " + clean(tr.Title)
+// GetPath returns where tmpl puts the track under root, without an extension
+func (tr Track) GetPath(root string, tmpl *Template) string {
+	return filepath.Join(root, tmpl.Render(tr))
 }
 
-func (tr Track) DoExists(root string) bool {
-	path := tr.GetPath(root)
-	matches, err := filepath.Glob("./" + path + ".*")
+func (tr Track) DoExists(root string, tmpl *Template) bool {
+	path := tr.GetPath(root, tmpl)
+	matches, err := filepath.Glob(globEscape(path) + ".*")
 	if err != nil {
 		return false
 	}
@@ -556,19 +863,25 @@ func (tr Track) DoExists(root string) bool {
 	return (len(matches) > 0)
 }
 
-func (t Tidal) DownloadTrack(root string, tr Track) error {
-	if tr.DoExists(root) {
+func (t Tidal) DownloadTrack(tmpl *Template, tr Track) error {
+	// TODO(ts): improve ID3
+	if al, ok := t.albumMap[tr.Album.ID.String()]; ok {
+		tr.Album = al
+	}
+
+	if tr.displayArtist == "" {
+		tr = t.ArtistFormat.apply(tr)
+	}
+
+	if tr.DoExists(t.Root, tmpl) {
 		return nil
 	}
 
-	// TODO(ts): improve ID3
-	al := t.albumMap[tr.Album.ID.String()]
-	tr.Album = al
+	tr.Album = t.withPictures(tr.Album)
 
-	os.MkdirAll(root, os.ModePerm)
+	path := tr.GetPath(t.Root, tmpl)
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
 
-	path := tr.GetPath(root)
-	
 	u, err := t.GetStreamURL(tr.ID.String(), "LOSSLESS")
 	if err != nil {
 		panic(err)
@@ -594,16 +907,177 @@ func (t Tidal) DownloadTrack(root string, tr Track) error {
 	f.Write(buf)
 	f.Close()
 
+	if t.Lyrics {
+		tr.lyrics, _ = t.GetLyrics(tr.ID.String())
+	}
+
 	kind, _ := filetype.Match(buf)
-	err = enc(root, tr, kind)
+	err = t.enc(path, tr, kind)
 	if err != nil {
 		panic(err)
 	}
 	os.Remove(path)
 
+	if _, err := os.Stat(path + ".flac"); err == nil && t.SeekTable > 0 {
+		if _, err := WriteSeekTable(path+".flac", t.SeekTable); err != nil {
+			return err
+		}
+	}
+
+	if err := writeLRC(path, tr); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func (t *Tidal) albumTemplate() *Template {
+	if t.AlbumTemplate != nil {
+		return t.AlbumTemplate.WithSanitizer(t.Sanitizer)
+	}
+	return DefaultAlbumTemplate.WithSanitizer(t.Sanitizer)
+}
+
+func (t *Tidal) playlistTemplate() *Template {
+	if t.PlaylistTemplate != nil {
+		return t.PlaylistTemplate.WithSanitizer(t.Sanitizer)
+	}
+	return DefaultPlaylistTemplate.WithSanitizer(t.Sanitizer)
+}
+
+// checkPaths returns ErrPathCollision when two tracks render to the same
+// path under tmpl. With SuffixCollisions set the later tracks get a suffix
+// instead and the renames are returned.
+func (t *Tidal) checkPaths(tmpl *Template, tracks []Track) ([]error, error) {
+	if !t.SuffixCollisions {
+		return nil, tmpl.Validate(tracks)
+	}
+
+	return tmpl.Disambiguate(tracks), nil
+}
+
+func (t *Tidal) mixTemplate() *Template {
+	if t.MixTemplate != nil {
+		return t.MixTemplate.WithSanitizer(t.Sanitizer)
+	}
+	return DefaultMixTemplate.WithSanitizer(t.Sanitizer)
+}
+
+// collectionDir is the directory shared by all tracks of an album or
+// playlist, where meta.json and album.jpg go
+func (t *Tidal) collectionDir(tmpl *Template, tracks []Track) string {
+	paths := make([]string, 0, len(tracks))
+	for _, tr := range tracks {
+		paths = append(paths, tmpl.Render(tr))
+	}
+
+	return filepath.Join(t.Root, commonDir(paths))
+}
+
+// artistDir returns the artist directory when the template starts with one,
+// and "" otherwise
+func (t *Tidal) artistDir(tmpl *Template, tr Track) string {
+	components := strings.Split(tmpl.Render(tr), "/")
+	if len(components) < 3 || components[0] != tmpl.sanitizer.Component(tr.albumArtist()) {
+		return ""
+	}
+
+	return filepath.Join(t.Root, components[0])
+}
+
+// numberDiscs fills in the album and per disc track totals of tracks, which
+// must all be from al, and returns al with NumberOfVolumes set
+func numberDiscs(al Album, tracks []Track) Album {
+	perDisc := make(map[string]int)
+	volumes := 1
+
+	for _, tr := range tracks {
+		perDisc[tr.disc()]++
+
+		if n, err := strconv.Atoi(tr.disc()); err == nil && n > volumes {
+			volumes = n
+		}
+	}
+
+	if al.NumberOfVolumes < volumes {
+		al.NumberOfVolumes = volumes
+	}
+
+	for i := range tracks {
+		tracks[i].Album = al
+		tracks[i].discTracks = perDisc[tracks[i].disc()]
+	}
+
+	return al
+}
+
+// disc is the track's disc number, tidal leaves it out for single disc albums
+func (tr Track) disc() string {
+	if tr.VolumeNumber.String() == "" {
+		return "1"
+	}
+
+	return tr.VolumeNumber.String()
+}
+
+func (tr Track) discTotal() string {
+	if tr.Album.NumberOfVolumes < 1 {
+		return "1"
+	}
+
+	return strconv.Itoa(tr.Album.NumberOfVolumes)
+}
+
+// albumName is the ALBUM tag, playlists are tagged as their own album
+func (tr Track) albumName() string {
+	if tr.Playlist.ID == "" {
+		return tr.Album.Title
+	}
+
+	if tr.Playlist.Snapshot != "" {
+		return fmt.Sprintf("%v (%v)", tr.Playlist.Title, tr.Playlist.Snapshot)
+	}
+
+	return tr.Playlist.Title
+}
+
+// trackTotal is the number of tracks on the track's disc, or in the playlist
+func (tr Track) trackTotal() string {
+	switch {
+	case tr.Playlist.ID != "":
+		return strconv.Itoa(tr.Playlist.NumberOfTracks)
+	case tr.discTracks > 0:
+		return strconv.Itoa(tr.discTracks)
+	}
+
+	return tr.Album.NumberOfTracks.String()
+}
+
+// albumArtist is the main artist of the track's album
+func (tr Track) albumArtist() string {
+	switch {
+	case tr.Album.Artist.Name != "":
+		return tr.Album.Artist.Name
+	case len(tr.Album.Artists) > 0:
+		return tr.Album.Artists[0].Name
+	}
+
+	return tr.Artist.Name
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
 // helper function to generate a uuid
 func uuid() string {
 	b := make([]byte, 16)
@@ -643,84 +1117,48 @@ func New(user, pass string) (*Tidal, error) {
 	return &t, json.NewDecoder(res.Body).Decode(&t)
 }
 
-func clean(s string) string {
-	return strings.Replace(s, "/", "\u2215", -1)
+// flacTags returns the vorbis comments of a track
+func (t *Tidal) flacTags(tr Track) Tags {
+	var tags Tags
+	tags.Add("TITLE", tr.titleName())
+	tags.Add("ALBUM", tr.albumName())
+	tags.Add("TRACKNUMBER", tr.TrackNumber.String())
+	tags.Add("TRACKTOTAL", tr.trackTotal())
+
+	if tr.Playlist.ID == "" {
+		tags.Add("DISCNUMBER", tr.disc())
+		tags.Add("DISCTOTAL", tr.discTotal())
+	}
+
+	tags.AddAll(t.ArtistFormat.artistTags(tr))
+	tags.Add("COPYRIGHT", tr.Copyright)
+	tags.AddAll(tr.metadataTags())
+	tags.Add("LYRICS", tr.lyrics.Unsynced())
+	tags.Add("ITUNESADVISORY", tr.advisory())
+
+	if tr.Playlist.ID != "" {
+		tags.Add("COMMENTS", fmt.Sprintf("Original Album Title: %v", tr.Album.Title))
+	}
+
+	return tags
 }
 
-func encFlac(src string, tr Track) error {
+func (t *Tidal) encFlac(path string, tr Track) error {
 	// https://wiki.hydrogenaud.io/index.php?title=Tag_Mapping#Titles
 	// Decode FLAC file.
-	path := src + "/" + clean(tr.Artist.Name) + " - " + clean(tr.Title)
 	stream, err := flac.ParseFile(path)
 	if err != nil {
 		// isn't a FLAC file
 		return err
 	}
 
-	// https://xiph.org/flac/format.html#metadata_block_picture
-	MIMETYPE := "image/jpeg"
-	pictureData := &bytes.Buffer{}
-	w := bitio.NewWriter(pictureData)
-	w.WriteBits(uint64(3), 32)                     // picture type (3)
-	w.WriteBits(uint64(len(MIMETYPE)), 32)         // length of "image/jpeg"
-	w.Write([]byte(MIMETYPE))                      // "image/jpeg"
-	w.WriteBits(uint64(0), 32)                     // description length (0)
-	w.Write([]byte{})                              // description
-	w.WriteBits(uint64(1280), 32)                  // width (1280)
-	w.WriteBits(uint64(1280), 32)                  // height (1280)
-	w.WriteBits(uint64(24), 32)                    // colour depth (24)
-	w.WriteBits(uint64(0), 32)                     // is pal? (0)
-	w.WriteBits(uint64(len(tr.Album.artBody)), 32) // length of content
-	w.Write(tr.Album.artBody)                      // actual content
-	w.Close()
-
-	encodedPictureData := base64.StdEncoding.EncodeToString(pictureData.Bytes())
-	foundComments := false
-	extraComments := ""
-
-	albumName := tr.Album.Title
-	trackTotal := tr.Album.NumberOfTracks.String()
-
-	if tr.Playlist.ID != "" {
-		extraComments += fmt.Sprintf("Original Album Title: %v\n", albumName)
-		albumName = tr.Playlist.Title
-		trackTotal = strconv.Itoa(tr.Playlist.NumberOfTracks)
-	}
-
-	comments := [][2]string{}
-	comments = append(comments, [2]string{"TITLE", tr.Title})
-	comments = append(comments, [2]string{"ALBUM", albumName})
-	comments = append(comments, [2]string{"TRACKNUMBER", tr.TrackNumber.String()})
-	comments = append(comments, [2]string{"TRACKTOTAL", trackTotal})
-
-	comments = append(comments, [2]string{"ARTIST", tr.Artist.Name})
-	comments = append(comments, [2]string{"ALBUMARTIST", tr.Album.Artist.Name})
-	
-	comments = append(comments, [2]string{"COPYRIGHT", tr.Copyright})
-	comments = append(comments, [2]string{"METADATA_BLOCK_PICTURE", encodedPictureData})
-	comments = append(comments, [2]string{"COMMENTS", extraComments})
-
-	// Add custom vorbis comment.
-	for _, block := range stream.Blocks {
-		if comment, ok := block.Body.(*meta.VorbisComment); ok {
-			foundComments = true
-			comment.Tags = append(comment.Tags, comments...)
-		}
-	}
+	comment := flacComment(stream)
+	comment.Tags = t.TagMerge.Merge(Tags(comment.Tags), t.flacTags(tr))
+	setPictures(stream, tr.Album.pictures)
 
-	if foundComments == false {
-		block := new(meta.Block)
-		block.IsLast = true
-		block.Type = meta.Type(4)
-		block.Length = 0
-
-		comment := new(meta.VorbisComment)
-		block.Body = comment
-		comment.Vendor = "Lavf57.71.100"
-		comment.Tags = append(comment.Tags, comments...)
-
-		stream.Blocks = append(stream.Blocks, block)
-	}
+	// leave room for retagging in place later
+	stripPadding(stream)
+	addPadding(stream, FlacPadding)
 
 	// Encode FLAC file.
 	f, err := os.Create(path + ".flac")
@@ -731,22 +1169,48 @@ func encFlac(src string, tr Track) error {
 	f.Close()
 	stream.Close()
 
-	return nil
+	return err
 }
 
-func encMp4(src string, tr Track) error {
-	path := src + "/" + clean(tr.Artist.Name) + " - " + clean(tr.Title)
-	return os.Rename(path, path + ".mp4")
+// encMp4 writes the ilst tags into the mp4 at path, audio only files get the
+// .m4a extension
+func (t *Tidal) encMp4(path string, tr Track) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	ext := ".m4a"
+	if mp4HasVideo(data) {
+		ext = ".mp4"
+	}
+
+	data, err = tagMP4(data, t.mp4Items(tr))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+ext, data, 0777)
 }
 
-func enc(src string, tr Track, kind types.Type) error {
+// enc tags the raw download at path and writes it out with an extension
+func (t *Tidal) enc(path string, tr Track, kind types.Type) error {
 	switch kind.MIME.Value {
 	case "audio/x-flac":
-		return encFlac(src, tr)
+		return t.encFlac(path, tr)
 	case "audio/mp4", "video/mp4":
-		return encMp4(src, tr)
+		// hi-res streams are often flac wrapped in mp4, unwrap them so they
+		// get tagged like any other flac
+		isFlac, err := remuxFlac(path)
+		if err != nil {
+			return err
+		}
+
+		if isFlac {
+			return t.encFlac(path, tr)
+		}
+
+		return t.encMp4(path, tr)
 	default:
 		fmt.Println(kind.MIME.Value)
 		return nil
@@ -0,0 +1,131 @@
+package tidl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+// redirectTransport sends every request to a test server instead
+type redirectTransport struct {
+	host string
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	req.URL.Host = rt.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testAPI points the client at handler for the rest of the test and returns
+// a session to talk to it with
+func testAPI(t *testing.T, handler http.Handler) *Tidal {
+	srv := httptest.NewServer(handler)
+
+	u, _ := url.Parse(srv.URL)
+	oldClient, oldLimiter := c, limiter
+	c = &http.Client{Transport: redirectTransport{u.Host}}
+	limiter = rate.NewLimiter(rate.Inf, 1)
+
+	t.Cleanup(func() {
+		c, limiter = oldClient, oldLimiter
+		srv.Close()
+	})
+
+	return &Tidal{CountryCode: "US", albumMap: map[string]Album{}}
+}
+
+// pagedHandler serves n numbered items in pages, failing the test on
+// anything but a single country code
+func pagedHandler(t *testing.T, n int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if cc := q["countryCode"]; len(cc) != 1 {
+			t.Errorf("%v: got country codes %v", r.URL.Path, cc)
+		}
+
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+
+		items := []json.RawMessage{}
+		for i := offset; i < offset+limit && i < n; i++ {
+			items = append(items, json.RawMessage(fmt.Sprintf(`{"id":%v}`, i)))
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"offset":             offset,
+			"limit":              limit,
+			"totalNumberOfItems": n,
+			"items":              items,
+		})
+	}
+}
+
+func TestGetPages(t *testing.T) {
+	for _, n := range []int{0, 1, pageSize, pageSize*2 + 7} {
+		td := testAPI(t, pagedHandler(t, n))
+
+		var got []int
+		err := td.getPages("things", url.Values{"filter": {"ALL"}}, func(raw json.RawMessage) error {
+			var item struct{ ID int }
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return err
+			}
+
+			got = append(got, item.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != n {
+			t.Fatalf("%v items: got %v", n, len(got))
+		}
+		for i, id := range got {
+			if id != i {
+				t.Fatalf("%v items: item %v has id %v", n, i, id)
+			}
+		}
+	}
+}
+
+func TestDownloadAlbumEmpty(t *testing.T) {
+	tests := []struct {
+		name   string
+		tracks string
+		album  Album
+	}{
+		{"no tracks", `{"items":[]}`, Album{ID: "1", Duration: 60, Artists: []Artist{{ID: "2"}}}},
+		{"no artists", `{"items":[{"id":3,"title":"Song"}]}`, Album{ID: "1", Duration: 60}},
+	}
+
+	for _, tt := range tests {
+		td := testAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tt.tracks)
+		}))
+
+		dir, err := ioutil.TempDir("", "tidl-album")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		td.Root = dir
+
+		if err := td.DownloadAlbum(tt.album); err == nil {
+			t.Errorf("%v: downloaded", tt.name)
+		}
+
+		if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+			t.Errorf("%v: wrote %v", tt.name, files[0].Name())
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package tidl
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Video struct
+type Video struct {
+	ID           json.Number `json:"id"`
+	Title        string      `json:"title"`
+	Duration     int         `json:"duration"`
+	ReleaseDate  string      `json:"releaseDate"`
+	TrackNumber  json.Number `json:"trackNumber"`
+	VolumeNumber json.Number `json:"volumeNumber"`
+	Explicit     bool        `json:"explicit"`
+	Quality      string      `json:"quality"`
+	ImageID      string      `json:"imageId"`
+	Type         string      `json:"type"`
+	Artist       Artist      `json:"artist"`
+	Artists      []Artist    `json:"artists"`
+	Album        Album       `json:"album"`
+}
+
+// ErrEncryptedStream is returned for HLS streams that need a decryption key
+var ErrEncryptedStream = errors.New("encrypted hls streams aren't supported")
+
+// GetVideo func
+func (t *Tidal) GetVideo(id string) (Video, error) {
+	var s Video
+	return s, t.get("videos/"+id, &url.Values{}, &s)
+}
+
+// GetAlbumVideos returns the videos listed alongside an album's tracks
+func (t *Tidal) GetAlbumVideos(id string) ([]Video, error) {
+	var s struct {
+		Items []struct {
+			Item Video  `json:"item"`
+			Type string `json:"type"`
+		} `json:"items"`
+	}
+
+	err := t.get("albums/"+id+"/items", &url.Values{
+		"limit": {"100"},
+	}, &s)
+
+	var videos []Video
+	for _, item := range s.Items {
+		if item.Type == "video" {
+			videos = append(videos, item.Item)
+		}
+	}
+
+	return videos, err
+}
+
+// GetVideoStreamURL returns the url of the HLS master playlist of a video
+func (t *Tidal) GetVideoStreamURL(id string) (string, error) {
+	var s struct {
+		ManifestMimeType string `json:"manifestMimeType"`
+		Manifest         string `json:"manifest"`
+	}
+
+	err := t.get("videos/"+id+"/playbackinfopostpaywall", &url.Values{
+		"videoquality":      {"HIGH"},
+		"playbackmode":      {"STREAM"},
+		"assetpresentation": {"FULL"},
+	}, &s)
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s.Manifest)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest struct {
+		MimeType string   `json:"mimeType"`
+		URLs     []string `json:"urls"`
+	}
+
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return "", err
+	}
+
+	if len(manifest.URLs) == 0 {
+		return "", errors.New("video unavailable")
+	}
+
+	return manifest.URLs[0], nil
+}
+
+func (v Video) GetArt() ([]byte, error) {
+	u := "https://resources.tidal.com/images/" + strings.Replace(v.ImageID, "-", "/", -1) + "/1280x720.jpg"
+	return fetch(u)
+}
+
+// videos that aren't part of an album go into the artist's Videos directory
+var videoTemplate = MustParseTemplate("{albumartist}/Videos/{artist} - {title}")
+
+// GetPath returns where tmpl puts the video under root, without an extension
+func (v Video) GetPath(root string, tmpl *Template, al Album) string {
+	return filepath.Join(root, tmpl.Render(Track{
+		ID:           v.ID,
+		Title:        v.Title,
+		Artist:       v.Artist,
+		Artists:      v.Artists,
+		Album:        al,
+		TrackNumber:  v.TrackNumber,
+		VolumeNumber: v.VolumeNumber,
+		Explicit:     v.Explicit,
+	}))
+}
+
+// DownloadVideo downloads a video next to its album, or into the artist's
+// Videos directory when it isn't part of one
+func (t *Tidal) DownloadVideo(v Video) error {
+	if v.Album.ID.String() != "" {
+		if al, err := t.GetAlbum(v.Album.ID.String()); err == nil {
+			return t.downloadVideo(t.albumTemplate(), v, al)
+		}
+	}
+
+	return t.downloadVideo(videoTemplate.WithSanitizer(t.Sanitizer), v, Album{})
+}
+
+func (t *Tidal) downloadVideo(tmpl *Template, v Video, al Album) error {
+	path := v.GetPath(t.Root, tmpl, al)
+	if _, err := os.Stat(path + ".ts"); err == nil {
+		return nil
+	}
+
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+
+	master, err := t.GetVideoStreamURL(v.ID.String())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+
+	err = DownloadHLS(master, t.VideoResolution, f)
+	f.Close()
+	if err != nil {
+		os.Remove(path + ".part")
+		return err
+	}
+
+	metadata, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".json", metadata, 0777)
+	if err != nil {
+		return err
+	}
+
+	if v.ImageID != "" {
+		if body, err := v.GetArt(); err == nil {
+			ioutil.WriteFile(path+".jpg", body, 0777)
+		}
+	}
+
+	return os.Rename(path+".part", path+".ts")
+}
+
+// HLSVariant is a single stream listed in an HLS master playlist
+type HLSVariant struct {
+	Bandwidth int
+	Width     int
+	Height    int
+	URI       string
+}
+
+// DownloadHLS resolves the master playlist at u, picks the variant closest to
+// (but not above) the requested height, and writes its MPEG-TS segments to w.
+// A height of 0 picks the best variant.
+func DownloadHLS(u string, height int, w io.Writer) error {
+	base, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+
+	body, err := fetch(u)
+	if err != nil {
+		return err
+	}
+
+	variants, err := ParseHLSMaster(base, string(body))
+	if err != nil {
+		return err
+	}
+
+	// a media playlist was handed to us directly
+	if len(variants) == 0 {
+		return downloadSegments(base, string(body), w)
+	}
+
+	variant := PickHLSVariant(variants, height)
+
+	media, err := url.Parse(variant.URI)
+	if err != nil {
+		return err
+	}
+
+	body, err = fetch(variant.URI)
+	if err != nil {
+		return err
+	}
+
+	return downloadSegments(media, string(body), w)
+}
+
+func downloadSegments(base *url.URL, playlist string, w io.Writer) error {
+	segments, err := ParseHLSMedia(base, playlist)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) == 0 {
+		return errors.New("hls playlist has no segments")
+	}
+
+	for _, segment := range segments {
+		res, err := c.Get(segment)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("unexpected status fetching segment: %d", res.StatusCode)
+		}
+
+		_, err = io.Copy(w, res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseHLSMaster returns the variants listed in a master playlist. It returns
+// no variants when the playlist is a media playlist.
+func ParseHLSMaster(base *url.URL, playlist string) ([]HLSVariant, error) {
+	var variants []HLSVariant
+	var pending *HLSVariant
+
+	scanner := bufio.NewScanner(strings.NewReader(playlist))
+	for i := 0; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if i == 0 && line != "#EXTM3U" {
+			return nil, errors.New("not an hls playlist")
+		}
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+
+			pending = &HLSVariant{}
+			pending.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+			if res := strings.SplitN(attrs["RESOLUTION"], "x", 2); len(res) == 2 {
+				pending.Width, _ = strconv.Atoi(res[0])
+				pending.Height, _ = strconv.Atoi(res[1])
+			}
+		case strings.HasPrefix(line, "#"):
+		case pending != nil:
+			ref, err := url.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+
+			pending.URI = base.ResolveReference(ref).String()
+			variants = append(variants, *pending)
+			pending = nil
+		}
+	}
+
+	return variants, scanner.Err()
+}
+
+// ParseHLSMedia returns the absolute segment urls of a media playlist
+func ParseHLSMedia(base *url.URL, playlist string) ([]string, error) {
+	var segments []string
+
+	scanner := bufio.NewScanner(strings.NewReader(playlist))
+	for i := 0; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if i == 0 && line != "#EXTM3U" {
+			return nil, errors.New("not an hls playlist")
+		}
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			if parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))["METHOD"] != "NONE" {
+				return nil, ErrEncryptedStream
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			ref, err := url.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+
+			segments = append(segments, base.ResolveReference(ref).String())
+		}
+	}
+
+	return segments, scanner.Err()
+}
+
+// PickHLSVariant picks the tallest variant not above height, falling back to
+// the smallest one. Ties are broken by bandwidth.
+func PickHLSVariant(variants []HLSVariant, height int) HLSVariant {
+	sorted := append([]HLSVariant(nil), variants...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Height != sorted[j].Height {
+			return sorted[i].Height > sorted[j].Height
+		}
+		return sorted[i].Bandwidth > sorted[j].Bandwidth
+	})
+
+	for _, v := range sorted {
+		if height <= 0 || v.Height <= height {
+			return v
+		}
+	}
+
+	return sorted[len(sorted)-1]
+}
+
+// parseHLSAttributes splits an attribute list, honouring quoted values
+func parseHLSAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				attrs[key] = s[1:]
+				break
+			}
+			value = s[1 : end+1]
+			s = s[end+2:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = s[:end]
+			s = s[end:]
+		}
+
+		attrs[key] = value
+		s = strings.TrimPrefix(s, ",")
+	}
+
+	return attrs
+}
+
+// fetch is a small helper for plain GETs outside of the api
+func fetch(u string) ([]byte, error) {
+	res, err := c.Get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,154 @@
+package tidl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// hlsFixture serves a master playlist with a 1080p and a 480p variant, each
+// with three segments whose bodies name the variant and segment
+func hlsFixture(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/video/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n"+
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=854x480,CODECS=\"avc1.4d401f,mp4a.40.2\"\n"+
+			"480/index.m3u8\n"+
+			"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\n"+
+			"/video/1080/index.m3u8\n")
+	})
+
+	for _, variant := range []string{"480", "1080"} {
+		variant := variant
+
+		mux.HandleFunc("/video/"+variant+"/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-KEY:METHOD=NONE\n"+
+				"#EXTINF:4.0,\nseg0.ts\n"+
+				"#EXTINF:4.0,\nseg1.ts\n"+
+				"#EXTINF:2.5,\nseg2.ts\n"+
+				"#EXT-X-ENDLIST\n")
+		})
+
+		for i := 0; i < 3; i++ {
+			body := segmentBody(variant, i)
+			mux.HandleFunc(fmt.Sprintf("/video/%v/seg%d.ts", variant, i), func(w http.ResponseWriter, r *http.Request) {
+				w.Write(body)
+			})
+		}
+	}
+
+	mux.HandleFunc("/encrypted.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXTINF:4.0,\nseg0.ts\n")
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func segmentBody(variant string, i int) []byte {
+	return []byte(fmt.Sprintf("[%v segment %d]", variant, i))
+}
+
+func concatSegments(variant string) []byte {
+	var b bytes.Buffer
+	for i := 0; i < 3; i++ {
+		b.Write(segmentBody(variant, i))
+	}
+	return b.Bytes()
+}
+
+func TestDownloadHLS(t *testing.T) {
+	srv := hlsFixture(t)
+
+	tests := []struct {
+		resolution int
+		variant    string
+	}{
+		{0, "1080"},
+		{1080, "1080"},
+		{2160, "1080"},
+		{720, "480"},
+		{480, "480"},
+		// nothing is small enough, the smallest is the best we can do
+		{360, "480"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := DownloadHLS(srv.URL+"/video/master.m3u8", tt.resolution, &out); err != nil {
+			t.Fatalf("resolution %v: %v", tt.resolution, err)
+		}
+
+		if want := concatSegments(tt.variant); !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("resolution %v: got %q, want %q", tt.resolution, out.Bytes(), want)
+		}
+	}
+}
+
+func TestDownloadHLSMediaPlaylist(t *testing.T) {
+	srv := hlsFixture(t)
+
+	var out bytes.Buffer
+	if err := DownloadHLS(srv.URL+"/video/480/index.m3u8", 1080, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := concatSegments("480"); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got %q, want %q", out.Bytes(), want)
+	}
+}
+
+func TestDownloadHLSEncrypted(t *testing.T) {
+	srv := hlsFixture(t)
+
+	err := DownloadHLS(srv.URL+"/encrypted.m3u8", 0, &bytes.Buffer{})
+	if !errors.Is(err, ErrEncryptedStream) {
+		t.Errorf("got %v, want ErrEncryptedStream", err)
+	}
+}
+
+func TestParseHLSMaster(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example/a/master.m3u8")
+	variants, err := ParseHLSMaster(base, "#EXTM3U\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=100,RESOLUTION=640x360,CODECS=\"a,b\"\n"+
+		"low.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=200\n"+
+		"https://other.example/high.m3u8\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []HLSVariant{
+		{Bandwidth: 100, Width: 640, Height: 360, URI: "https://cdn.example/a/low.m3u8"},
+		{Bandwidth: 200, URI: "https://other.example/high.m3u8"},
+	}
+
+	if fmt.Sprint(variants) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", variants, want)
+	}
+
+	if _, err := ParseHLSMaster(base, "not a playlist"); err == nil {
+		t.Error("parsed a non playlist")
+	}
+}
+
+func TestPickHLSVariant(t *testing.T) {
+	variants := []HLSVariant{
+		{Bandwidth: 1, Height: 720, URI: "720-low"},
+		{Bandwidth: 2, Height: 720, URI: "720-high"},
+		{Bandwidth: 3, Height: 1080, URI: "1080"},
+		{Bandwidth: 4, Height: 360, URI: "360"},
+	}
+
+	for height, want := range map[int]string{0: "1080", 1080: "1080", 1000: "720-high", 720: "720-high", 480: "360", 100: "360"} {
+		if got := PickHLSVariant(variants, height).URI; got != want {
+			t.Errorf("height %v: got %v, want %v", height, got, want)
+		}
+	}
+}